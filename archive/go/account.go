@@ -0,0 +1,99 @@
+package tapp
+
+import (
+	"fmt"
+	"strings"
+	"context"
+	"net/http"
+)
+
+type accountKey struct{}
+
+// trackedAccounts are the screen names archived by this instance, the first
+// is served on the unprefixed routes
+func trackedAccounts() []string {
+	if len(AppConfig.Accounts) > 0 {
+		return AppConfig.Accounts
+	}
+	return []string{AppConfig.ScreenName}
+}
+
+func defaultAccount() string {
+	return trackedAccounts()[0]
+}
+
+// trackedAccount returns the configured spelling of a tracked screen name
+func trackedAccount(screenName string) (string, bool) {
+	for _, account := range trackedAccounts() {
+		if strings.EqualFold(account, screenName) {
+			return account, true
+		}
+	}
+	return "", false
+}
+
+func withAccount(ctx context.Context, screenName string) context.Context {
+	return context.WithValue(ctx, accountKey{}, screenName)
+}
+
+// accountFrom is the account a request is for, the default account unless
+// it came in on a /{screenName}/ route
+func accountFrom(ctx context.Context) string {
+	if screenName, ok := ctx.Value(accountKey{}).(string); ok {
+		return screenName
+	}
+	return defaultAccount()
+}
+
+// requestAccount is the ?account= of admin requests, falling back to the
+// route's account
+func requestAccount(ctx context.Context, r *http.Request) (string, error) {
+	name := r.URL.Query().Get("account")
+	if name == "" {
+		return accountFrom(ctx), nil
+	}
+	if account, ok := trackedAccount(name); ok {
+		return account, nil
+	}
+	return "", BadRequest("Unknown account: %v", name)
+}
+
+// accountHandler serves /{screenName}/... for a tracked account by stripping
+// the screen name and serving the rest of the path for that account
+func accountHandler(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		account, ok := trackedAccount(parts[0])
+		if ok == false || r.Context().Value(accountKey{}) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rest := "/"
+		if len(parts) > 1 {
+			rest += parts[1]
+		}
+		r2 := r.WithContext(withAccount(r.Context(), account))
+		u := *r.URL
+		u.Path = rest
+		u.RawPath = ""
+		r2.URL = &u
+		mux.ServeHTTP(w, r2)
+	})
+}
+
+// forEachAccount runs a job for every tracked account, carrying on past
+// failures so one account can't hold up the others
+func forEachAccount(ctx context.Context, job func(context.Context, string) error) error {
+	failed := []string{}
+	for _, account := range trackedAccounts() {
+		if err := job(withAccount(ctx, account), account); err != nil {
+			applog.Errorf(ctx, "Error running job for %v: %v", account, err)
+			failed = append(failed, account + ": " + err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Error in %v of %v accounts: %v", len(failed), len(trackedAccounts()), strings.Join(failed, "; "))
+	}
+	return nil
+}
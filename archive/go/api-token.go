@@ -0,0 +1,204 @@
+package tapp
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"context"
+	"net/http"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/base64"
+)
+
+// apiScopes are the scopes a token can be granted:
+//
+//	read           read only admin endpoints, e.g. /admin/jobs
+//	admin:delete   /admin/delete
+//	admin:archive  /admin/archive/import and /admin/archive/export
+//	cron           the cron job routes
+var apiScopes = map[string]bool{
+	SCOPE_READ: true,
+	SCOPE_ADMIN_DELETE: true,
+	SCOPE_ADMIN_ARCHIVE: true,
+	SCOPE_CRON: true,
+}
+
+// ApiToken is a bearer token for scripts. Tokens look like
+// tapp_<id>_<secret>, only a sha256 hash of the secret is stored.
+type ApiToken struct {
+	Id string
+	Name string
+	Hash string `datastore:",noindex"`
+	Scopes []string
+	Created int64
+	LastUsed int64
+}
+
+func (token ApiToken) HasScope(scope string) bool {
+	for _, s := range token.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiTokenInfo is an ApiToken as listed to admins, without its hash
+type apiTokenInfo struct {
+	Id string
+	Name string
+	Scopes []string
+	Created int64
+	LastUsed int64
+}
+
+func (token ApiToken) info() apiTokenInfo {
+	return apiTokenInfo{
+		Id: token.Id,
+		Name: token.Name,
+		Scopes: token.Scopes,
+		Created: token.Created,
+		LastUsed: token.LastUsed,
+	}
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// createApiToken stores a new token and returns it with its plain text value,
+// which cannot be recovered later
+func createApiToken(ctx context.Context, name string, scopes []string) (*ApiToken, string, error) {
+	for _, scope := range scopes {
+		if apiScopes[scope] == false {
+			return nil, "", BadRequest("Unknown scope: %q", scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, "", BadRequest("A token needs at least one scope")
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+
+	token := &ApiToken{
+		Id: hex.EncodeToString(id),
+		Name: name,
+		Hash: hashTokenSecret(encoded),
+		Scopes: scopes,
+		Created: time.Now().Unix(),
+	}
+	if err := TokenStorage.PutApiToken(ctx, *token); err != nil {
+		return nil, "", err
+	}
+	return token, API_TOKEN_PREFIX + token.Id + "_" + encoded, nil
+}
+
+// authorizeApiToken checks a bearer token for scope, returning a 401 for
+// unknown tokens and a 403 for tokens without the scope
+func authorizeApiToken(ctx context.Context, value string, scope string) error {
+	parts := strings.SplitN(strings.TrimPrefix(value, API_TOKEN_PREFIX), "_", 2)
+	if strings.HasPrefix(value, API_TOKEN_PREFIX) == false || len(parts) != 2 {
+		return Unauthorized("Invalid token")
+	}
+
+	token, err := TokenStorage.GetApiToken(ctx, parts[0])
+	if err == ErrNotFound {
+		return Unauthorized("Invalid token")
+	} else if err != nil {
+		return fmt.Errorf("Error getting api token: %v", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(hashTokenSecret(parts[1])), []byte(token.Hash)) != 1 {
+		return Unauthorized("Invalid token")
+	}
+	if token.HasScope(scope) == false {
+		return &HttpError{Status: http.StatusForbidden, Msg: fmt.Sprintf("Token lacks the %v scope", scope)}
+	}
+
+	// only record use about once an hour to spare writes
+	now := time.Now().Unix()
+	if now - token.LastUsed > 3600 {
+		token.LastUsed = now
+		if err = TokenStorage.PutApiToken(ctx, *token); err != nil {
+			applog.Warningf(ctx, "Error updating api token last use: %v", err)
+		}
+	}
+	return nil
+}
+
+// tokensHandler lists tokens on GET and creates one on POST from the name
+// and scope form values
+func tokensHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var resp interface{}
+	switch r.Method {
+	case "GET":
+		tokens, err := TokenStorage.ListApiTokens(ctx)
+		if err != nil {
+			return fmt.Errorf("Error listing api tokens: %v", err)
+		}
+		infos := []apiTokenInfo{}
+		for _, token := range tokens {
+			infos = append(infos, token.info())
+		}
+		resp = infos
+	case "POST":
+		if err := r.ParseForm(); err != nil {
+			return BadRequest("Invalid form: %v", err)
+		}
+		token, value, err := createApiToken(ctx, strings.TrimSpace(r.PostForm.Get("name")), r.PostForm["scope"])
+		if err != nil {
+			return err
+		}
+		applog.Infof(ctx, "created api token %v with scopes %v", token.Id, token.Scopes)
+		resp = struct {
+			Token string
+			Info apiTokenInfo
+		} {
+			Token: value,
+			Info: token.info(),
+		}
+	default:
+		return MethodNotAllowed(r.Method, "GET", "POST")
+	}
+
+	respJson, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("Error marshaling json for api tokens: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if r.Method == "POST" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	_, err = w.Write(respJson)
+	return err
+}
+
+func revokeTokenHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return MethodNotAllowed(r.Method, "POST")
+	}
+	id := r.FormValue("id")
+	if _, err := TokenStorage.GetApiToken(ctx, id); err == ErrNotFound {
+		return NotFound("Token %v not found", id)
+	} else if err != nil {
+		return fmt.Errorf("Error getting api token: %v", err)
+	}
+	if err := TokenStorage.DeleteApiToken(ctx, id); err != nil {
+		return fmt.Errorf("Error revoking api token: %v", err)
+	}
+	applog.Infof(ctx, "revoked api token %v", id)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
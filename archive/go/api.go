@@ -0,0 +1,181 @@
+package tapp
+
+import (
+	"fmt"
+	"time"
+	"path"
+	"strconv"
+	"strings"
+	"context"
+	"net/http"
+	"encoding/json"
+)
+
+// ApiResponse is the envelope around every /api/v1 response
+type ApiResponse struct {
+	Data interface{} `json:"data"`
+	// cursors of the neighbouring pages, null for single items
+	Page *ApiPage `json:"page"`
+	HasMore bool `json:"hasMore"`
+	// number of items across all pages, null when unknown
+	Total *int `json:"total"`
+	// unix time the data was cached, null when it was read fresh
+	CachedAt *int64 `json:"cachedAt"`
+	// search query with unknown words corrected
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+type ApiPage struct {
+	Size int `json:"size"`
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// cachedTweetPage is the first page of a tweet list as kept in the cache
+type cachedTweetPage struct {
+	Page TweetPage
+	Total int
+	CachedAt int64
+}
+
+func registerApiRoutes(mux *http.ServeMux) {
+	mux.HandleFunc(API_PREFIX + "/user", appHandler(apiUserHandler))
+	mux.HandleFunc(API_PREFIX + "/users", appHandler(apiUsersHandler))
+	mux.HandleFunc(API_PREFIX + "/tweet", appHandler(apiTweetHandler))
+	mux.HandleFunc(API_PREFIX + "/tweets/latest", appHandler(apiTweetsHandler))
+	mux.HandleFunc(API_PREFIX + "/tweets/best", appHandler(apiTweetsHandler))
+	mux.HandleFunc(API_PREFIX + "/tweets/search", appHandler(apiSearchHandler))
+}
+
+func writeApiResponse(w http.ResponseWriter, resp ApiResponse) error {
+	respJson, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("Error marshaling json for api response: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, err = w.Write(respJson)
+	return err
+}
+
+func apiTweetsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+	which := strings.TrimPrefix(path.Clean(r.URL.Path), API_PREFIX + "/tweets/")
+	order, ok := tweetOrders[which]
+	if ok == false {
+		return NotFound("Unknown tweet list: %v", which)
+	}
+	limit, err := pageSize(params)
+	if err != nil {
+		return BadRequest("%v", err)
+	}
+
+	var cached cachedTweetPage
+	account := accountFrom(ctx)
+	cacheKey := tweetsCacheKey(MEMCACHE_API_TWEETS_KEY, account, which)
+	cursor := params.Get("cursor")
+	// only the default first page is cached, cursors are cheap to follow
+	useCache := cursor == "" && limit == AppConfig.TweetsToFetch
+	if useCache && cache.Get(ctx, cacheKey, &cached) == nil {
+		return writeTweetPage(w, cached.Page, cached.Total, &cached.CachedAt)
+	}
+
+	page, err := getTweetPage(ctx, account, order, cursor, limit)
+	if err == ErrInvalidCursor {
+		return BadRequest("%v", err)
+	} else if err != nil {
+		return fmt.Errorf("Error getting %v tweets: %v", which, err)
+	}
+	total, err := TweetStorage.CountTweets(ctx, account)
+	if err != nil {
+		return fmt.Errorf("Error getting tweet total: %v", err)
+	}
+
+	if useCache {
+		cache.Set(ctx, cacheKey, cachedTweetPage{
+			Page: *page,
+			Total: total,
+			CachedAt: time.Now().Unix(),
+		})
+	}
+	return writeTweetPage(w, *page, total, nil)
+}
+
+func writeTweetPage(w http.ResponseWriter, page TweetPage, total int, cachedAt *int64) error {
+	resp := ApiResponse{
+		Data: page.Tweets,
+		Page: &ApiPage{Size: page.PageSize, Next: page.Next, Prev: page.Prev},
+		HasMore: page.Next != "",
+		CachedAt: cachedAt,
+	}
+	if total >= 0 {
+		resp.Total = &total
+	}
+	return writeApiResponse(w, resp)
+}
+
+func apiSearchHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+	limit, err := pageSize(params)
+	if err != nil {
+		return BadRequest("%v", err)
+	}
+	popularity, _ := strconv.ParseFloat(params.Get("popularity"), 64)
+
+	opts := SearchOptions{
+		Owner: accountFrom(ctx),
+		Search: params.Get("search"),
+		Order: params.Get("order"),
+		Cursor: params.Get("cursor"),
+		Limit: limit,
+		Popularity: popularity,
+	}
+	result, err := getSearchTweets(ctx, opts)
+	if err != nil {
+		return searchError(err, opts)
+	}
+
+	return writeApiResponse(w, ApiResponse{
+		Data: result.Hits,
+		Page: &ApiPage{Size: result.PageSize, Next: result.Next, Prev: result.Prev},
+		HasMore: result.Next != "",
+		Total: &result.Total,
+		Suggestion: result.Suggestion,
+	})
+}
+
+func apiTweetHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		return BadRequest("Invalid tweet id: %q", r.URL.Query().Get("id"))
+	}
+	tweet, err := TweetStorage.GetTweet(ctx, id)
+	if err == ErrNotFound {
+		return NotFound("Tweet %v not found", id)
+	} else if err != nil {
+		return fmt.Errorf("Error getting tweet from datastore: %v", err)
+	}
+	return writeApiResponse(w, ApiResponse{Data: tweet})
+}
+
+func apiUserHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account := accountFrom(ctx)
+	if cached := getCachedUser(ctx, account); cached != nil {
+		return writeApiResponse(w, ApiResponse{Data: cached.User, CachedAt: &cached.CachedAt})
+	}
+
+	// a user missing from the cache and datastore is fetched from twitter
+	user, err := getUser(ctx, account)
+	if err != nil {
+		return Upstream(err, "Error getting user")
+	}
+	return writeApiResponse(w, ApiResponse{Data: user})
+}
+
+func apiUsersHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	users, err := getTrackedUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("Error getting users: %v", err)
+	}
+	total := len(users)
+	return writeApiResponse(w, ApiResponse{Data: users, Total: &total})
+}
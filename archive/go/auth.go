@@ -0,0 +1,278 @@
+package tapp
+
+import (
+	"fmt"
+	"time"
+	"bytes"
+	"strings"
+	"context"
+	"net/http"
+	"net/url"
+	"html/template"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/base64"
+	"encoding/binary"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/appengine"
+)
+
+// sessionKey signs session cookies, it comes from the sessionSecret
+// setting so sessions survive restarts and work across instances. Without
+// one there are no sessions.
+func sessionKey() []byte {
+	if AppConfig.SessionSecret == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(AppConfig.SessionSecret))
+	return sum[:]
+}
+
+// validateAdmin only lets through requests with a logged in session, an
+// admin token from the config, or an API token granted scope (an empty
+// scope allows no API tokens). Session requests that change state also need
+// the CSRF token in an X-CSRF-Token header or csrf_token form field.
+func validateAdmin(scope string, handler appEngineHandler) appEngineHandler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		if token, ok := bearerToken(r); ok {
+			if validAdminToken(token) {
+				return handler(ctx, w, r)
+			}
+			if scope == "" {
+				applog.Warningf(ctx, "invalid admin token for %v", r.URL.Path)
+				return Unauthorized("Invalid token")
+			}
+			if err := authorizeApiToken(ctx, token, scope); err != nil {
+				applog.Warningf(ctx, "api token refused for %v", r.URL.Path)
+				return err
+			}
+			return handler(ctx, w, r)
+		}
+
+		session, ok := readSession(ctx, r)
+		if ok == false {
+			if r.Method == "GET" && prefersHtml(r.Header.Get("Accept")) {
+				http.Redirect(w, r, "/admin/login?next=" + url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return nil
+			}
+			return Unauthorized("Login required")
+		}
+		if isMutating(r.Method) && validCsrf(r, session) == false {
+			applog.Warningf(ctx, "missing or invalid csrf token for %v", r.URL.Path)
+			return &HttpError{Status: http.StatusForbidden, Msg: "Invalid CSRF token"}
+		}
+		return handler(ctx, w, r)
+	}
+}
+
+func isMutating(method string) bool {
+	return method != "GET" && method != "HEAD" && method != "OPTIONS"
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") == false {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")), true
+}
+
+// validAdminToken checks token against the sha256 hex hashes listed in the
+// adminTokenHashes credential
+func validAdminToken(token string) bool {
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+	valid := false
+	for _, allowed := range AppConfig.AdminTokenHashes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(strings.ToLower(allowed))) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// a session is its expiry and a random id, signed with the session key
+type session struct {
+	Expires int64
+	Id []byte
+}
+
+// AdminSession is a logged in session as stored, logging out deletes it so
+// its cookie stops working on every instance
+type AdminSession struct {
+	Id string
+	Expires int64
+}
+
+func (s session) stored() AdminSession {
+	return AdminSession{Id: hex.EncodeToString(s.Id), Expires: s.Expires}
+}
+
+func newSession() session {
+	s := session{Expires: time.Now().Add(AppConfig.SessionLength).Unix(), Id: make([]byte, 16)}
+	rand.Read(s.Id)
+	return s
+}
+
+func (s session) payload() []byte {
+	buf := make([]byte, 8, 8 + len(s.Id))
+	binary.BigEndian.PutUint64(buf, uint64(s.Expires))
+	return append(buf, s.Id...)
+}
+
+func (s session) cookieValue() string {
+	payload := s.payload()
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signSession(payload))
+}
+
+// csrfToken is derived from the session so it needs no storage
+func (s session) csrfToken() string {
+	return base64.RawURLEncoding.EncodeToString(signSession(append([]byte("csrf:"), s.Id...)))
+}
+
+func signSession(data []byte) []byte {
+	mac := hmac.New(sha256.New, sessionKey())
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func readSession(ctx context.Context, r *http.Request) (session, bool) {
+	cookie, err := r.Cookie(SESSION_COOKIE)
+	if err != nil || sessionKey() == nil {
+		return session{}, false
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return session{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(payload) <= 8 {
+		return session{}, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || hmac.Equal(sig, signSession(payload)) == false {
+		return session{}, false
+	}
+
+	s := session{Expires: int64(binary.BigEndian.Uint64(payload[:8])), Id: payload[8:]}
+	if time.Now().Unix() > s.Expires {
+		return session{}, false
+	}
+	if _, err = TokenStorage.GetAdminSession(ctx, s.stored().Id); err != nil {
+		if err != ErrNotFound {
+			applog.Errorf(ctx, "Error getting session: %v", err)
+		}
+		return session{}, false
+	}
+	return s, true
+}
+
+func validCsrf(r *http.Request, s session) bool {
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.FormValue("csrf_token")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.csrfToken())) == 1
+}
+
+func setSessionCookies(w http.ResponseWriter, r *http.Request, s session, maxAge int) {
+	secure := appengine.IsAppEngine() || r.TLS != nil
+	http.SetCookie(w, &http.Cookie{
+		Name: SESSION_COOKIE,
+		Value: s.cookieValue(),
+		Path: "/",
+		MaxAge: maxAge,
+		Secure: secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	// readable by the admin page scripts, which echo it in X-CSRF-Token
+	http.SetCookie(w, &http.Cookie{
+		Name: CSRF_COOKIE,
+		Value: s.csrfToken(),
+		Path: "/admin",
+		MaxAge: maxAge,
+		Secure: secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Admin login</title></head>
+<body>
+<form id="login" method="POST" action="/admin/login">
+  {{if .Failed}}<div class="error">Wrong password</div>{{end}}
+  <input type="hidden" name="next" value="{{.Next}}">
+  <input type="password" name="password" autofocus>
+  <button type="submit">Log in</button>
+</form>
+</body>
+</html>
+`))
+
+func loginHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	next := r.FormValue("next")
+	// only redirect back into the admin pages
+	if strings.HasPrefix(next, "/admin") == false {
+		next = "/admin"
+	}
+
+	switch r.Method {
+	case "GET":
+		return renderLogin(w, next, false)
+	case "POST":
+		if AppConfig.AdminPasswordHash == "" {
+			applog.Warningf(ctx, "admin login attempted without an adminPasswordHash credential")
+			return Unauthorized("Admin login is not configured")
+		}
+		err := bcrypt.CompareHashAndPassword([]byte(AppConfig.AdminPasswordHash), []byte(r.FormValue("password")))
+		if err != nil {
+			applog.Warningf(ctx, "failed admin login from %v", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return renderLogin(w, next, true)
+		}
+		s := newSession()
+		if err = TokenStorage.PutAdminSession(ctx, s.stored()); err != nil {
+			return fmt.Errorf("Error storing session: %v", err)
+		}
+		setSessionCookies(w, r, s, int(AppConfig.SessionLength / time.Second))
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return nil
+	}
+	return MethodNotAllowed(r.Method, "GET", "POST")
+}
+
+func renderLogin(w http.ResponseWriter, next string, failed bool) error {
+	var buf bytes.Buffer
+	err := loginPage.Execute(&buf, struct {
+		Next string
+		Failed bool
+	} {
+		Next: next,
+		Failed: failed,
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func logoutHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return MethodNotAllowed(r.Method, "POST")
+	}
+	if s, ok := readSession(ctx, r); ok {
+		if err := TokenStorage.DeleteAdminSession(ctx, s.stored().Id); err != nil {
+			return fmt.Errorf("Error deleting session: %v", err)
+		}
+	}
+	setSessionCookies(w, r, session{}, -1)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,74 @@
+package tapp
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"path"
+	"errors"
+	"strings"
+	"context"
+)
+
+var (
+	ErrBlobNotFound = errors.New("tapp: blob not found")
+	ErrInvalidBlobName = errors.New("tapp: invalid blob name")
+
+	// MediaStorage keeps the archived media files, picked by the mediaStore
+	// setting
+	MediaStorage BlobStore = &gcsBlobStore{}
+)
+
+// BlobStore keeps files by slash separated names such as
+// status/<id>/photo/0.jpg
+type BlobStore interface {
+	Put(ctx context.Context, name string, r io.Reader, contentType string) error
+	// Get opens a blob for reading, seekable so ranges can be served, the
+	// caller closes it
+	Get(ctx context.Context, name string) (io.ReadSeekCloser, *BlobInfo, error)
+	Stat(ctx context.Context, name string) (*BlobInfo, error)
+	Delete(ctx context.Context, name string) error
+	// List returns the blobs whose names start with prefix
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+	// Close releases the store's client, on shutdown
+	Close() error
+}
+
+type BlobInfo struct {
+	Name string
+	Size int64
+	ContentType string
+	Updated time.Time
+	// changes whenever the content does, unquoted
+	ETag string
+}
+
+// NewBlobStore returns the media store the config selects
+func NewBlobStore(cfg *Config) (BlobStore, error) {
+	switch cfg.MediaStore {
+	case "", MEDIA_STORE_GCS:
+		return &gcsBlobStore{bucket: cfg.Bucket}, nil
+	case MEDIA_STORE_LOCAL:
+		return NewLocalBlobStore(cfg.MediaDir)
+	case MEDIA_STORE_S3:
+		return NewS3BlobStore(cfg)
+	}
+	return nil, fmt.Errorf("Error unknown media store: %q", cfg.MediaStore)
+}
+
+// validBlobName rejects names that are empty, absolute or could climb out
+// of a directory
+func validBlobName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return false
+	}
+	if path.Clean(name) != name {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." || part == "." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package tapp
+
+import (
+	"io"
+	"strings"
+	"context"
+	"testing"
+)
+
+// testBlobStore runs a blob through Put, Get, Stat, List and Delete
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+	name := "status/1/photo/0.jpg"
+	if err := store.Put(ctx, name, strings.NewReader("jpeg bytes"), "image/jpeg"); err != nil {
+		t.Fatalf("Error putting blob: %v", err)
+	}
+
+	rc, info, err := store.Get(ctx, name)
+	if err != nil {
+		t.Fatalf("Error getting blob: %v", err)
+	}
+	data, err := io.ReadAll(rc)
+	if err != nil || string(data) != "jpeg bytes" || info.Size != 10 {
+		t.Errorf("get = %q, %v, size %v", data, err, info.Size)
+	}
+	if _, err = rc.Seek(5, io.SeekStart); err != nil {
+		t.Fatalf("Error seeking blob: %v", err)
+	}
+	if data, err = io.ReadAll(rc); err != nil || string(data) != "bytes" {
+		t.Errorf("read after seek = %q, %v", data, err)
+	}
+	rc.Close()
+
+	stat, err := store.Stat(ctx, name)
+	if err != nil || stat.Size != 10 || stat.ContentType != "image/jpeg" || stat.ETag == "" {
+		t.Errorf("stat = %+v, %v", stat, err)
+	}
+	// a stream of unknown size
+	if err = store.Put(ctx, name, io.MultiReader(strings.NewReader("new jpeg bytes")), "image/jpeg"); err != nil {
+		t.Fatalf("Error replacing blob: %v", err)
+	}
+	if replaced, err := store.Stat(ctx, name); err != nil || replaced.Size != 14 || replaced.ETag == stat.ETag {
+		t.Errorf("stat after replacing = %+v, %v", replaced, err)
+	}
+
+	if infos, err := store.List(ctx, "status/1/"); err != nil || len(infos) != 1 || infos[0].Name != name {
+		t.Errorf("list status/1/ = %+v, %v", infos, err)
+	}
+	if infos, err := store.List(ctx, "status/2/"); err != nil || len(infos) != 0 {
+		t.Errorf("list status/2/ = %+v, %v", infos, err)
+	}
+
+	if err = store.Delete(ctx, name); err != nil {
+		t.Fatalf("Error deleting blob: %v", err)
+	}
+	if _, _, err = store.Get(ctx, name); err != ErrBlobNotFound {
+		t.Errorf("get after delete = %v, want ErrBlobNotFound", err)
+	}
+	if _, err = store.Stat(ctx, name); err != ErrBlobNotFound {
+		t.Errorf("stat after delete = %v, want ErrBlobNotFound", err)
+	}
+	if err = store.Delete(ctx, name); err != ErrBlobNotFound {
+		t.Errorf("second delete = %v, want ErrBlobNotFound", err)
+	}
+
+	for _, invalid := range []string{"", "/status/1", "../status/1", "status/../1", "status/./1", "status\\1"} {
+		if err = store.Put(ctx, invalid, strings.NewReader("x"), "text/plain"); err != ErrInvalidBlobName {
+			t.Errorf("put %q = %v, want ErrInvalidBlobName", invalid, err)
+		}
+		if _, _, err = store.Get(ctx, invalid); err != ErrInvalidBlobName {
+			t.Errorf("get %q = %v, want ErrInvalidBlobName", invalid, err)
+		}
+		if _, err = store.Stat(ctx, invalid); err != ErrInvalidBlobName {
+			t.Errorf("stat %q = %v, want ErrInvalidBlobName", invalid, err)
+		}
+		if err = store.Delete(ctx, invalid); err != ErrInvalidBlobName {
+			t.Errorf("delete %q = %v, want ErrInvalidBlobName", invalid, err)
+		}
+	}
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening media dir: %v", err)
+	}
+	testBlobStore(t, store)
+}
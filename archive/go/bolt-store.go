@@ -0,0 +1,713 @@
+package tapp
+
+import (
+	"time"
+	"sort"
+	"bytes"
+	"strings"
+	"context"
+	"encoding/json"
+	"encoding/binary"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltTweetBucket = []byte("MyTweet")
+	boltUserBucket = []byte("User")
+	boltIndexBucket = []byte("IndexTerm")
+	boltStatsBucket = []byte("IndexStats")
+	boltTokenBucket = []byte("ApiToken")
+	boltAuthBucket = []byte("TwitterAuth")
+	boltMediaRefBucket = []byte("MediaRef")
+	boltDownloadBucket = []byte("MediaDownload")
+	boltSnapshotBucket = []byte("UserSnapshot")
+	boltJobBucket = []byte("JobLease")
+	boltCountBucket = []byte("TweetCount")
+	boltSessionBucket = []byte("AdminSession")
+	boltAuditBucket = []byte("MediaAudit")
+	boltStatsKey = []byte("stats")
+	boltAuditKey = []byte("latest")
+)
+
+// BoltStore keeps tweets, users and the search index in an embedded BoltDB
+// file, for running tapp without App Engine
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltTweetBucket, boltUserBucket, boltIndexBucket, boltStatsBucket, boltTokenBucket, boltAuthBucket, boltMediaRefBucket, boltDownloadBucket, boltSnapshotBucket, boltJobBucket, boltSessionBucket, boltAuditBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(boltCountBucket) != nil {
+			return nil
+		}
+		// count the tweets stored before the counts were kept
+		counts, err := tx.CreateBucket(boltCountBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltTweetBucket).ForEach(func(key []byte, val []byte) error {
+			var tweet MyTweet
+			if err := json.Unmarshal(val, &tweet); err != nil {
+				return err
+			}
+			if tweet.Deleted {
+				return nil
+			}
+			return addTweetCount(counts, tweet.Owner, 1)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) GetTweet(ctx context.Context, id int64) (*MyTweet, error) {
+	var tweet *MyTweet
+	err := s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltTweetBucket).Get(boltTweetKey(id))
+		if val == nil {
+			return ErrNotFound
+		}
+		tweet = &MyTweet{}
+		return json.Unmarshal(val, tweet)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tweet, nil
+}
+
+func (s *BoltStore) GetTweets(ctx context.Context, ids []int64) ([]MyTweet, error) {
+	tweets := []MyTweet{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltTweetBucket)
+		for _, id := range ids {
+			val := bucket.Get(boltTweetKey(id))
+			if val == nil {
+				continue
+			}
+			var tweet MyTweet
+			if err := json.Unmarshal(val, &tweet); err != nil {
+				return err
+			}
+			tweets = append(tweets, tweet)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tweets, nil
+}
+
+func (s *BoltStore) GetLatestTweet(ctx context.Context, owner string) (*MyTweet, error) {
+	var tweet *MyTweet
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// keys are big endian ids, so walk back from the highest id
+		c := tx.Bucket(boltTweetBucket).Cursor()
+		for key, val := c.Last(); key != nil; key, val = c.Prev() {
+			var t MyTweet
+			if err := json.Unmarshal(val, &t); err != nil {
+				return err
+			}
+			if t.OwnedBy(owner) {
+				tweet = &t
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tweet, nil
+}
+
+func (s *BoltStore) QueryTweets(ctx context.Context, query TweetQuery) ([]MyTweet, error) {
+	tweets := []MyTweet{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTweetBucket).ForEach(func(key []byte, val []byte) error {
+			var tweet MyTweet
+			if err := json.Unmarshal(val, &tweet); err != nil {
+				return err
+			}
+			tweets = append(tweets, tweet)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filterAndSortTweets(tweets, query)
+}
+
+func (s *BoltStore) PutTweets(ctx context.Context, tweets []MyTweet) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltTweetBucket)
+		counts := tx.Bucket(boltCountBucket)
+		for _, tweet := range tweets {
+			if val := bucket.Get(boltTweetKey(tweet.Id)); val != nil {
+				var old MyTweet
+				if err := json.Unmarshal(val, &old); err != nil {
+					return err
+				}
+				if old.Deleted == false {
+					if err := addTweetCount(counts, old.Owner, -1); err != nil {
+						return err
+					}
+				}
+			}
+			if tweet.Deleted == false {
+				if err := addTweetCount(counts, tweet.Owner, 1); err != nil {
+					return err
+				}
+			}
+
+			val, err := json.Marshal(tweet)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(boltTweetKey(tweet.Id), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) CountTweets(ctx context.Context, owner string) (int, error) {
+	var count int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		counts := tx.Bucket(boltCountBucket)
+		count = boltTweetCount(counts, owner)
+		// tweets stored before Owner was set belong to the default account
+		if strings.EqualFold(owner, defaultAccount()) {
+			count += boltTweetCount(counts, "")
+		}
+		return nil
+	})
+	return int(count), err
+}
+
+// boltCountKey is the TweetCount key of an owner, bolt keys can't be empty
+func boltCountKey(owner string) []byte {
+	return []byte("@" + strings.ToLower(owner))
+}
+
+func boltTweetCount(counts *bolt.Bucket, owner string) int64 {
+	val := counts.Get(boltCountKey(owner))
+	if val == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(val))
+}
+
+// addTweetCount adds n to the owner's count of tweets that are not deleted
+func addTweetCount(counts *bolt.Bucket, owner string, n int64) error {
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, uint64(boltTweetCount(counts, owner) + n))
+	return counts.Put(boltCountKey(owner), val)
+}
+
+func (s *BoltStore) GetUser(ctx context.Context, screenName string) (*User, error) {
+	var user *User
+	err := s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltUserBucket).Get([]byte(screenName))
+		if val == nil {
+			return ErrNotFound
+		}
+		user = &User{}
+		return json.Unmarshal(val, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *BoltStore) ListUsers(ctx context.Context) ([]User, error) {
+	users := []User{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUserBucket).ForEach(func(key []byte, val []byte) error {
+			var user User
+			if err := json.Unmarshal(val, &user); err != nil {
+				return err
+			}
+			users = append(users, user)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *BoltStore) PutUser(ctx context.Context, user User) error {
+	val, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUserBucket).Put([]byte(user.ScreenName), val)
+	})
+}
+
+// snapshots are keyed by account then time, so an account's are in order
+func boltSnapshotKey(account string, taken int64) []byte {
+	return append([]byte(strings.ToLower(account) + "/"), boltTweetKey(taken)...)
+}
+
+func (s *BoltStore) PutUserSnapshot(ctx context.Context, snapshot UserSnapshot) error {
+	val, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSnapshotBucket).Put(boltSnapshotKey(snapshot.Account, snapshot.Taken), val)
+	})
+}
+
+func (s *BoltStore) ListUserSnapshots(ctx context.Context, account string) ([]UserSnapshot, error) {
+	snapshots := []UserSnapshot{}
+	prefix := []byte(strings.ToLower(account) + "/")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltSnapshotBucket).Cursor()
+		for key, val := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, val = c.Next() {
+			var snapshot UserSnapshot
+			if err := json.Unmarshal(val, &snapshot); err != nil {
+				return err
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+func (s *BoltStore) GetApiToken(ctx context.Context, id string) (*ApiToken, error) {
+	var token *ApiToken
+	err := s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltTokenBucket).Get([]byte(id))
+		if val == nil {
+			return ErrNotFound
+		}
+		token = &ApiToken{}
+		return json.Unmarshal(val, token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *BoltStore) ListApiTokens(ctx context.Context) ([]ApiToken, error) {
+	tokens := []ApiToken{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTokenBucket).ForEach(func(key []byte, val []byte) error {
+			var token ApiToken
+			if err := json.Unmarshal(val, &token); err != nil {
+				return err
+			}
+			tokens = append(tokens, token)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created < tokens[j].Created
+	})
+	return tokens, nil
+}
+
+func (s *BoltStore) PutApiToken(ctx context.Context, token ApiToken) error {
+	val, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTokenBucket).Put([]byte(token.Id), val)
+	})
+}
+
+func (s *BoltStore) DeleteApiToken(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTokenBucket).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) GetTwitterAuth(ctx context.Context, screenName string) (*TwitterAuth, error) {
+	var auth *TwitterAuth
+	err := s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltAuthBucket).Get([]byte(strings.ToLower(screenName)))
+		if val == nil {
+			return ErrNotFound
+		}
+		auth = &TwitterAuth{}
+		return json.Unmarshal(val, auth)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+func (s *BoltStore) PutTwitterAuth(ctx context.Context, auth TwitterAuth) error {
+	val, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAuthBucket).Put([]byte(strings.ToLower(auth.ScreenName)), val)
+	})
+}
+
+func (s *BoltStore) GetAdminSession(ctx context.Context, id string) (*AdminSession, error) {
+	var session AdminSession
+	err := s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltSessionBucket).Get([]byte(id))
+		if val == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(val, &session)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *BoltStore) PutAdminSession(ctx context.Context, session AdminSession) error {
+	val, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessionBucket).Put([]byte(session.Id), val)
+	})
+}
+
+func (s *BoltStore) DeleteAdminSession(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessionBucket).Delete([]byte(id))
+	})
+}
+
+// the lease is read and written in one bolt transaction, which bolt never
+// runs two of at once
+func (s *BoltStore) AcquireJobLease(ctx context.Context, name string, holder string, expires int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltJobBucket)
+		lease := JobLease{Name: name}
+		if val := bucket.Get([]byte(name)); val != nil {
+			if err := json.Unmarshal(val, &lease); err != nil {
+				return err
+			}
+		}
+		if lease.heldByOther(holder, time.Now().Unix()) {
+			return ErrJobRunning
+		}
+		lease.Holder = holder
+		lease.Expires = expires
+		val, err := json.Marshal(lease)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), val)
+	})
+}
+
+func (s *BoltStore) ReleaseJobLease(ctx context.Context, released JobLease) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltJobBucket)
+		var lease JobLease
+		if val := bucket.Get([]byte(released.Name)); val != nil {
+			if err := json.Unmarshal(val, &lease); err != nil {
+				return err
+			}
+		}
+		if lease.Holder != released.Holder {
+			return nil
+		}
+		released.Holder = ""
+		released.Expires = 0
+		val, err := json.Marshal(released)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(released.Name), val)
+	})
+}
+
+func (s *BoltStore) ListJobLeases(ctx context.Context) ([]JobLease, error) {
+	leases := []JobLease{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltJobBucket).ForEach(func(key []byte, val []byte) error {
+			var lease JobLease
+			if err := json.Unmarshal(val, &lease); err != nil {
+				return err
+			}
+			leases = append(leases, lease)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+func (s *BoltStore) GetMediaRef(ctx context.Context, path string) (*MediaRef, error) {
+	var ref *MediaRef
+	err := s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltMediaRefBucket).Get([]byte(path))
+		if val == nil {
+			return ErrNotFound
+		}
+		ref = &MediaRef{}
+		return json.Unmarshal(val, ref)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+func (s *BoltStore) ListMediaRefs(ctx context.Context) ([]MediaRef, error) {
+	refs := []MediaRef{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMediaRefBucket).ForEach(func(key []byte, val []byte) error {
+			var ref MediaRef
+			if err := json.Unmarshal(val, &ref); err != nil {
+				return err
+			}
+			refs = append(refs, ref)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func (s *BoltStore) PutMediaRef(ctx context.Context, ref MediaRef) error {
+	val, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMediaRefBucket).Put([]byte(ref.Path), val)
+	})
+}
+
+func (s *BoltStore) ListMediaDownloads(ctx context.Context) ([]MediaDownload, error) {
+	downloads := []MediaDownload{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDownloadBucket).ForEach(func(key []byte, val []byte) error {
+			var download MediaDownload
+			if err := json.Unmarshal(val, &download); err != nil {
+				return err
+			}
+			downloads = append(downloads, download)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(downloads, func(i, j int) bool {
+		return downloads[i].NextAttempt < downloads[j].NextAttempt
+	})
+	return downloads, nil
+}
+
+func (s *BoltStore) PutMediaDownload(ctx context.Context, download MediaDownload) error {
+	val, err := json.Marshal(download)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDownloadBucket).Put([]byte(download.Path), val)
+	})
+}
+
+func (s *BoltStore) DeleteMediaDownload(ctx context.Context, path string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDownloadBucket).Delete([]byte(path))
+	})
+}
+
+func (s *BoltStore) GetMediaAudit(ctx context.Context) (*MediaAudit, error) {
+	var audit MediaAudit
+	err := s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltAuditBucket).Get(boltAuditKey)
+		if val == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(val, &audit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &audit, nil
+}
+
+func (s *BoltStore) PutMediaAudit(ctx context.Context, audit MediaAudit) error {
+	val, err := json.Marshal(audit)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAuditBucket).Put(boltAuditKey, val)
+	})
+}
+
+func (s *BoltStore) GetTerms(ctx context.Context, tokens []string) ([]IndexTerm, error) {
+	terms := []IndexTerm{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltIndexBucket)
+		for _, token := range tokens {
+			val := bucket.Get([]byte(token))
+			if val == nil {
+				continue
+			}
+			postings, err := decodePostings(val)
+			if err != nil {
+				return err
+			}
+			terms = append(terms, IndexTerm{Token: token, Postings: postings})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return terms, nil
+}
+
+func (s *BoltStore) ListTokens(ctx context.Context, prefix string, limit int) ([]string, error) {
+	tokens := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltIndexBucket).Cursor()
+		for key, _ := c.Seek([]byte(prefix)); key != nil && bytes.HasPrefix(key, []byte(prefix)); key, _ = c.Next() {
+			if limit > 0 && len(tokens) == limit {
+				break
+			}
+			tokens = append(tokens, string(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *BoltStore) UpdateTerms(ctx context.Context, updates []TermUpdate) ([]string, error) {
+	changed := []string{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		changed = changed[:0]
+		bucket := tx.Bucket(boltIndexBucket)
+		for _, update := range updates {
+			postings := []Posting{}
+			val := bucket.Get([]byte(update.Token))
+			if val != nil {
+				var err error
+				if postings, err = decodePostings(val); err != nil {
+					return err
+				}
+			}
+
+			var err error
+			postings = update.apply(postings)
+			if len(postings) == 0 {
+				err = bucket.Delete([]byte(update.Token))
+			} else {
+				err = bucket.Put([]byte(update.Token), encodePostings(postings))
+			}
+			if err != nil {
+				return err
+			}
+			if (val != nil) != (len(postings) > 0) {
+				changed = append(changed, update.Token)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+func (s *BoltStore) ClearTerms(ctx context.Context) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltIndexBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(boltIndexBucket); err != nil {
+			return err
+		}
+		return tx.Bucket(boltStatsBucket).Delete(boltStatsKey)
+	})
+}
+
+func (s *BoltStore) GetStats(ctx context.Context) (IndexStats, error) {
+	var stats IndexStats
+	err := s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltStatsBucket).Get(boltStatsKey)
+		if val == nil {
+			return nil
+		}
+		return json.Unmarshal(val, &stats)
+	})
+	return stats, err
+}
+
+func (s *BoltStore) AddStats(ctx context.Context, delta IndexStats) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltStatsBucket)
+		var stats IndexStats
+		if val := bucket.Get(boltStatsKey); val != nil {
+			if err := json.Unmarshal(val, &stats); err != nil {
+				return err
+			}
+		}
+		stats.Docs += delta.Docs
+		stats.Tokens += delta.Tokens
+		val, err := json.Marshal(stats)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(boltStatsKey, val)
+	})
+}
+
+func boltTweetKey(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
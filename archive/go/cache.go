@@ -0,0 +1,82 @@
+package tapp
+
+import (
+	"sync"
+	"context"
+	"encoding/json"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// Cache holds JSON encoded values, backed by memcache on App Engine and by
+// process memory otherwise
+type Cache interface {
+	Get(ctx context.Context, key string, v interface{}) error
+	Set(ctx context.Context, key string, v interface{}) error
+	Delete(ctx context.Context, key string) error
+}
+
+var cache Cache = platformCache{memory: &memoryCache{items: map[string][]byte{}}}
+
+type platformCache struct {
+	memory *memoryCache
+}
+
+func (c platformCache) Get(ctx context.Context, key string, v interface{}) error {
+	if appengine.IsAppEngine() {
+		_, err := memcache.JSON.Get(ctx, key, v)
+		return err
+	}
+	return c.memory.Get(ctx, key, v)
+}
+
+func (c platformCache) Set(ctx context.Context, key string, v interface{}) error {
+	if appengine.IsAppEngine() {
+		return memcache.JSON.Set(ctx, &memcache.Item{Key: key, Object: v})
+	}
+	return c.memory.Set(ctx, key, v)
+}
+
+func (c platformCache) Delete(ctx context.Context, key string) error {
+	if appengine.IsAppEngine() {
+		err := memcache.Delete(ctx, key)
+		if err == memcache.ErrCacheMiss {
+			return nil
+		}
+		return err
+	}
+	return c.memory.Delete(ctx, key)
+}
+
+type memoryCache struct {
+	mu sync.RWMutex
+	items map[string][]byte
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string, v interface{}) error {
+	c.mu.RLock()
+	val, ok := c.items[key]
+	c.mu.RUnlock()
+	if ok == false {
+		return memcache.ErrCacheMiss
+	}
+	return json.Unmarshal(val, v)
+}
+
+func (c *memoryCache) Set(ctx context.Context, key string, v interface{}) error {
+	val, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.items[key] = val
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	delete(c.items, key)
+	c.mu.Unlock()
+	return nil
+}
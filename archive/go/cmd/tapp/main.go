@@ -0,0 +1,154 @@
+// Command tapp serves the tapp archive from a plain net/http server, without
+// App Engine. Run it from the directory holding the config file and the html
+// templates.
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"log"
+	"bufio"
+	"strings"
+	"flag"
+	"time"
+	"context"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"golang.org/x/crypto/bcrypt"
+	tapp "github.com/vincekd/tapp/archive/go"
+)
+
+func main() {
+	addr := flag.String("addr", defaultAddr(), "address to listen on")
+	dbPath := flag.String("db", "tapp.db", "path to the BoltDB database file")
+	configPath := flag.String("config", tapp.DefaultConfigPath(), "yaml config file, settings can also come from TAPP_* environment variables")
+	bucket := flag.String("bucket", "", "bucket for media files, overrides the bucket setting")
+	cronFile := flag.String("cron", "cron.yaml", "cron.yaml with job schedules, empty to disable the scheduler")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30 * time.Second, "time to wait for open requests on shutdown")
+	hashPassword := flag.Bool("hash-password", false, "read a password from stdin and print its bcrypt hash for the adminPasswordHash setting")
+	setSecret := flag.String("set-secret", "", "read a value from stdin and seal it in the secretsFile under this setting name, e.g. consumerKeySecret")
+	rotateSecrets := flag.Bool("rotate-secrets", false, "re-seal the secretsFile with TAPP_SECRETS_KEY, keeping TAPP_SECRETS_OLD_KEYS only to open it")
+	flag.Parse()
+
+	if *hashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalf("Error reading password: %v", err)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(password, "\r\n")), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatalf("Error hashing password: %v", err)
+		}
+		fmt.Println(string(hash))
+		return
+	}
+
+	if *setSecret != "" || *rotateSecrets {
+		if err := editSecrets(*configPath, *setSecret, *rotateSecrets); err != nil {
+			log.Fatalf("Error updating secrets: %v", err)
+		}
+		return
+	}
+
+	cfg, err := tapp.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if *bucket != "" {
+		cfg.Bucket = *bucket
+	}
+	if err = tapp.SetConfig(cfg); err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := tapp.MediaStorage.Close(); err != nil {
+			log.Printf("Error closing media store: %v", err)
+		}
+	}()
+
+	store, err := tapp.NewBoltStore(*dbPath)
+	if err != nil {
+		log.Fatalf("Error opening database %q: %v", *dbPath, err)
+	}
+	defer store.Close()
+	tapp.SetStorage(store, store, store, store, store, store)
+
+	server := &http.Server{
+		Addr: *addr,
+		Handler: tapp.NewRouter(),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *cronFile != "" {
+		schedules, err := tapp.LoadSchedules(*cronFile)
+		if err != nil {
+			log.Fatalf("Error loading schedules: %v", err)
+		}
+		if err = tapp.Jobs.Start(ctx, schedules); err != nil {
+			log.Fatalf("Error starting scheduler: %v", err)
+		}
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %v", *addr)
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err = <-errs:
+		if err != http.ErrServerClosed {
+			log.Fatalf("Error serving: %v", err)
+		}
+	case <-ctx.Done():
+		log.Printf("Shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err = server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down: %v", err)
+		}
+	}
+}
+
+// editSecrets seals a value read from stdin into the secrets file, or
+// re-seals the file with the current key
+func editSecrets(configPath string, name string, rotate bool) error {
+	cfg, _ := tapp.LoadConfig(configPath)
+	if cfg.SecretsFile == "" {
+		return fmt.Errorf("no secretsFile setting in %q", configPath)
+	}
+	keys, err := tapp.KeyringFromEnv()
+	if err != nil {
+		return err
+	}
+	secrets, err := tapp.OpenFileSecrets(cfg.SecretsFile, keys)
+	if err != nil {
+		return err
+	}
+
+	if rotate {
+		rotated, err := secrets.Rotate()
+		if err != nil {
+			return err
+		}
+		log.Printf("Re-sealed %v secrets", rotated)
+		return nil
+	}
+
+	value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return secrets.SetSecret(name, strings.TrimRight(value, "\r\n"))
+}
+
+func defaultAddr() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
@@ -0,0 +1,376 @@
+package tapp
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"net/url"
+	"io/ioutil"
+	"encoding/hex"
+	"path/filepath"
+	"github.com/ChimeraCoder/anaconda"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the effective configuration. It is read from a yaml file, each
+// setting can be overridden by an environment variable named after its key,
+// e.g. tweetsToFetch by TAPP_TWEETS_TO_FETCH. Settings tagged secret are never
+// shown on the admin page, and are best left out of the file: those still
+// empty are filled from the Secrets provider.
+type Config struct {
+	// twitter app keys
+	ConsumerKey string `yaml:"consumerKey" secret:"true"`
+	ConsumerKeySecret string `yaml:"consumerKeySecret" secret:"true"`
+	// fallback access token for ScreenName, unused once it's connected at
+	// /admin/connect
+	AccessToken string `yaml:"accessToken" secret:"true"`
+	AccessTokenSecret string `yaml:"accessTokenSecret" secret:"true"`
+	ScreenName string `yaml:"screenName"`
+	// screen names to archive, spelled as on twitter, defaults to just ScreenName
+	Accounts []string `yaml:"accounts"`
+
+	// scheme and host tapp is served at, e.g. https://tapp.example.com, for
+	// the /admin/connect callback. On App Engine it defaults to the app's
+	// default hostname.
+	PublicUrl string `yaml:"publicUrl"`
+	GaKey string `yaml:"gaTrackingId"`
+	// where media files are kept: gcs, local or s3
+	MediaStore string `yaml:"mediaStore"`
+	// bucket of the gcs and s3 media stores, gcs falls back to the App
+	// Engine default bucket
+	Bucket string `yaml:"bucket"`
+	// directory of the local media store
+	MediaDir string `yaml:"mediaDir"`
+	// host[:port] of the s3 media store, e.g. s3.amazonaws.com or
+	// localhost:9000 for a MinIO server
+	S3Endpoint string `yaml:"s3Endpoint"`
+	S3Region string `yaml:"s3Region"`
+	S3AccessKey string `yaml:"s3AccessKey" secret:"true"`
+	S3SecretKey string `yaml:"s3SecretKey" secret:"true"`
+	// plain http to the endpoint
+	S3Insecure bool `yaml:"s3Insecure"`
+
+	// bcrypt hash of the /admin login password
+	AdminPasswordHash string `yaml:"adminPasswordHash" secret:"true"`
+	// sha256 hex hashes of bearer tokens allowed on /admin routes
+	AdminTokenHashes []string `yaml:"adminTokenHashes" secret:"true"`
+	// signs admin session cookies, required with adminPasswordHash
+	SessionSecret string `yaml:"sessionSecret" secret:"true"`
+	SessionLength time.Duration `yaml:"sessionLength"`
+	// seals the secrets kept in the datastore, at least 32 random bytes in
+	// base64, e.g. from openssl rand -base64 32
+	EncryptionKey string `yaml:"encryptionKey" secret:"true"`
+	// keys rotated out of EncryptionKey, still used to open old values
+	OldEncryptionKeys []string `yaml:"oldEncryptionKeys" secret:"true"`
+	// sealed secrets file, secrets come from the environment when empty
+	SecretsFile string `yaml:"secretsFile"`
+
+	// default page size, and the page size of the legacy ?page= lists
+	TweetsToFetch int `yaml:"tweetsToFetch"`
+	MaxPageSize int `yaml:"maxPageSize"`
+	MinRatio float32 `yaml:"minRatio"`
+	// datastore batch size, at most 500
+	MaxPutSize int `yaml:"maxPutSize"`
+	// tweets per twitter lookup request, at most 100
+	MaxApiLookupSize int `yaml:"maxApiLookupSize"`
+	SummaryLength int `yaml:"summaryLength"`
+	SnippetContext int `yaml:"snippetContext"`
+	MaxFuzzyDistance int `yaml:"maxFuzzyDistance"`
+	// indexed words a prefix* term may match before the search is refused
+	MaxTermExpansion int `yaml:"maxTermExpansion"`
+	DaysBeforeUnretweet int `yaml:"daysBeforeUnretweet"`
+
+	// file the config was read from, empty if only the environment was used
+	source string
+	secrets SecretProvider
+}
+
+// ConfigError lists every problem found validating a Config
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "Error invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+var (
+	AppConfig = DefaultConfig()
+
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+func DefaultConfig() *Config {
+	return &Config{
+		MediaStore: MEDIA_STORE_GCS,
+		MediaDir: "media",
+		SessionLength: 7 * 24 * time.Hour,
+		TweetsToFetch: 30,
+		MaxPageSize: 200,
+		MinRatio: 0.10,
+		MaxPutSize: 500,
+		MaxApiLookupSize: 100,
+		SummaryLength: 30,
+		SnippetContext: 60,
+		MaxFuzzyDistance: 2,
+		MaxTermExpansion: 500,
+		DaysBeforeUnretweet: 6,
+	}
+}
+
+// DefaultConfigPath is $TAPP_CONFIG, or config.yaml, or the legacy json
+// credentials file, whichever exists first. It is empty when there is none.
+func DefaultConfigPath() string {
+	if path := os.Getenv(CONFIG_PATH_ENV); path != "" {
+		return path
+	}
+	for _, path := range []string{CONFIG_FILE, LEGACY_CREDENTIALS_FILE} {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// LoadConfig reads the config at path, or only the environment when path is
+// empty, over the defaults. The config is returned along with any error so
+// the caller can decide whether to carry on with it.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("Error reading config %q: %v", path, err)
+		}
+		// json is yaml, but the credentials file has keys no longer used
+		unmarshal := yaml.UnmarshalStrict
+		if filepath.Base(path) == LEGACY_CREDENTIALS_FILE {
+			unmarshal = yaml.Unmarshal
+		}
+		if err = unmarshal(data, cfg); err != nil {
+			return cfg, fmt.Errorf("Error parsing config %q: %v", path, err)
+		}
+		cfg.source = path
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+	secrets, err := cfg.secretProvider()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.secrets = secrets
+	if err = cfg.applySecrets(secrets); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// SetConfig makes cfg the running configuration, leaving the old one in place
+// if its media store can't be opened
+func SetConfig(cfg *Config) error {
+	store, err := NewBlobStore(cfg)
+	if err != nil {
+		return fmt.Errorf("Error opening media store: %v", err)
+	}
+	MediaStorage = store
+
+	AppConfig = cfg
+	if cfg.secrets != nil {
+		Secrets = cfg.secrets
+	}
+	anaconda.SetConsumerKey(cfg.ConsumerKey)
+	anaconda.SetConsumerSecret(cfg.ConsumerKeySecret)
+	return nil
+}
+
+func (cfg *Config) applyEnv() error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := configKey(t.Field(i))
+		if key == "" {
+			continue
+		}
+		raw, ok := os.LookupEnv(configEnv(key))
+		if ok == false {
+			continue
+		}
+		if err := setConfigField(v.Field(i), raw); err != nil {
+			return fmt.Errorf("Error reading %v: %v", configEnv(key), err)
+		}
+	}
+	return nil
+}
+
+func setConfigField(field reflect.Value, raw string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Float32:
+		f, err := strconv.ParseFloat(raw, 32)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		// comma separated
+		vals := []string{}
+		for _, val := range strings.Split(raw, ",") {
+			if val = strings.TrimSpace(val); val != "" {
+				vals = append(vals, val)
+			}
+		}
+		field.Set(reflect.ValueOf(vals))
+	default:
+		return fmt.Errorf("unsupported setting type %v", field.Type())
+	}
+	return nil
+}
+
+func configKey(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("yaml"), ",")[0]
+}
+
+// configEnv is the environment variable of a config key, tweetsToFetch is
+// TAPP_TWEETS_TO_FETCH
+func configEnv(key string) string {
+	var b strings.Builder
+	b.WriteString(CONFIG_ENV_PREFIX)
+	for i, r := range key {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func (cfg *Config) Validate() error {
+	problems := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if ok == false {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(cfg.ScreenName != "" || len(cfg.Accounts) > 0, "screenName or accounts is required")
+	seen := map[string]bool{}
+	for _, account := range cfg.Accounts {
+		check(account != "", "accounts has an empty screen name")
+		check(seen[strings.ToLower(account)] == false, "accounts lists %v twice", account)
+		seen[strings.ToLower(account)] = true
+	}
+	check((cfg.ConsumerKey == "") == (cfg.ConsumerKeySecret == ""), "consumerKey and consumerKeySecret must be set together")
+	check((cfg.AccessToken == "") == (cfg.AccessTokenSecret == ""), "accessToken and accessTokenSecret must be set together")
+	check(cfg.AdminPasswordHash == "" || strings.HasPrefix(cfg.AdminPasswordHash, "$2"), "adminPasswordHash is not a bcrypt hash")
+	for _, key := range append([]string{cfg.EncryptionKey}, cfg.OldEncryptionKeys...) {
+		if key != "" {
+			_, err := deriveKey(key)
+			check(err == nil, "encryptionKey and oldEncryptionKeys must be at least %v random bytes in base64", MASTER_KEY_LENGTH)
+		}
+	}
+	if cfg.PublicUrl != "" {
+		u, err := url.Parse(cfg.PublicUrl)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && strings.Trim(u.Path, "/") == "", "publicUrl must be an http or https url without a path, got %q", cfg.PublicUrl)
+	}
+	for _, hash := range cfg.AdminTokenHashes {
+		_, err := hex.DecodeString(hash)
+		check(err == nil && len(hash) == 64, "adminTokenHashes has an entry that is not a sha256 hex hash")
+	}
+	switch cfg.MediaStore {
+	case MEDIA_STORE_GCS:
+	case MEDIA_STORE_LOCAL:
+		check(cfg.MediaDir != "", "mediaDir is required by the local media store")
+	case MEDIA_STORE_S3:
+		check(cfg.S3Endpoint != "", "s3Endpoint is required by the s3 media store")
+		check(cfg.Bucket != "", "bucket is required by the s3 media store")
+		check((cfg.S3AccessKey == "") == (cfg.S3SecretKey == ""), "s3AccessKey and s3SecretKey must be set together")
+	default:
+		check(false, "mediaStore must be gcs, local or s3, got %q", cfg.MediaStore)
+	}
+	check(cfg.AdminPasswordHash == "" || len(cfg.SessionSecret) >= 16, "sessionSecret of at least 16 characters is required with adminPasswordHash")
+	check(cfg.SessionLength >= time.Minute, "sessionLength must be at least 1m, got %v", cfg.SessionLength)
+
+	check(cfg.MaxPageSize >= 1, "maxPageSize must be at least 1, got %v", cfg.MaxPageSize)
+	check(cfg.TweetsToFetch >= 1 && cfg.TweetsToFetch <= cfg.MaxPageSize, "tweetsToFetch must be 1 to maxPageSize, got %v", cfg.TweetsToFetch)
+	check(cfg.MinRatio >= 0, "minRatio must not be negative, got %v", cfg.MinRatio)
+	check(cfg.MaxPutSize >= 1 && cfg.MaxPutSize <= 500, "maxPutSize must be 1 to 500, got %v", cfg.MaxPutSize)
+	check(cfg.MaxApiLookupSize >= 1 && cfg.MaxApiLookupSize <= 100, "maxApiLookupSize must be 1 to 100, got %v", cfg.MaxApiLookupSize)
+	check(cfg.SummaryLength >= 1, "summaryLength must be at least 1, got %v", cfg.SummaryLength)
+	check(cfg.SnippetContext >= 0, "snippetContext must not be negative, got %v", cfg.SnippetContext)
+	check(cfg.MaxFuzzyDistance >= 0 && cfg.MaxFuzzyDistance <= 3, "maxFuzzyDistance must be 0 to 3, got %v", cfg.MaxFuzzyDistance)
+	check(cfg.MaxTermExpansion >= 1, "maxTermExpansion must be at least 1, got %v", cfg.MaxTermExpansion)
+	check(cfg.DaysBeforeUnretweet >= 0, "daysBeforeUnretweet must not be negative, got %v", cfg.DaysBeforeUnretweet)
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// configSetting is one setting as shown on the admin page, secrets only
+// say whether they are set
+type configSetting struct {
+	Key string
+	Env string
+	Value interface{}
+	Secret bool
+	Set bool
+}
+
+type configView struct {
+	Source string
+	Settings []configSetting
+}
+
+func (cfg *Config) view() configView {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	view := configView{Source: cfg.source, Settings: []configSetting{}}
+	for i := 0; i < t.NumField(); i++ {
+		key := configKey(t.Field(i))
+		if key == "" {
+			continue
+		}
+		field := v.Field(i)
+		setting := configSetting{
+			Key: key,
+			Env: configEnv(key),
+			Secret: t.Field(i).Tag.Get("secret") == "true",
+			Set: field.IsZero() == false,
+		}
+		if setting.Secret == false {
+			setting.Value = field.Interface()
+			if field.Type() == durationType {
+				setting.Value = field.Interface().(time.Duration).String()
+			}
+		}
+		view.Settings = append(view.Settings, setting)
+	}
+	return view
+}
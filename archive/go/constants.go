@@ -1,19 +1,58 @@
 package tapp
 
+import "time"
+
 const (
 	TWITTER_URL = "https://twitter.com/"
 	MEMCACHE_TWEETS_KEY = "TWEETS."
 	MEMCACHE_USER_KEY = "USER."
-	TWEETS_TO_FETCH = 30
-	MIN_RATIO = float32(0.10)
-	MAX_PUT_SIZE int = 500
-	MAX_API_LOOKUP_SIZE int = 100
-	MIN_SEARCH_LENGTH int = 2
+	MEMCACHE_API_TWEETS_KEY = "API.TWEETS."
+	MEMCACHE_OAUTH_KEY = "OAUTH.REQUEST."
+	MEMCACHE_VOCABULARY_KEY = "SEARCH.VOCABULARY."
+	INDEX_SHARD_BITS = 53
+	OAUTH_REQUEST_LENGTH = 15 * time.Minute
+	JOB_LEASE_LENGTH = 10 * time.Minute
+	API_PREFIX = "/api/v1"
+	CONFIG_FILE = "config.yaml"
+	LEGACY_CREDENTIALS_FILE = "credentials"
+	CONFIG_PATH_ENV = "TAPP_CONFIG"
+	CONFIG_ENV_PREFIX = "TAPP_"
+	SECRETS_KEY_ENV = "TAPP_SECRETS_KEY"
+	SECRETS_OLD_KEYS_ENV = "TAPP_SECRETS_OLD_KEYS"
+	KEY_ID_LENGTH = 4
+	MASTER_KEY_LENGTH = 32
+	SEAL_KEY_INFO = "tapp seal v1"
+	MEDIA_STORE_GCS = "gcs"
+	MEDIA_STORE_LOCAL = "local"
+	MEDIA_STORE_S3 = "s3"
+	S3_PART_SIZE = 16 * 1024 * 1024
+	MEDIA_MAX_AGE = 30 * 24 * time.Hour
+	MEDIA_RETRY_BACKOFF = 30 * time.Minute
+	MEDIA_RETRY_LIMIT = 8
+	MEDIA_MISSING = "missing"
+	MEDIA_EMPTY = "empty"
+	MEDIA_HASH_MISMATCH = "hash mismatch"
+	MEDIA_UNREADABLE = "unreadable"
+	MEDIA_AUDIT_BATCH = 200
+	MEDIA_AUDIT_MAX_PROBLEMS = 1000
+	MEDIA_AUDIT_INTERVAL = 7 * 24 * time.Hour
+	MEDIA_AUDIT_JOB_BUDGET = 5 * time.Minute
+	MEDIA_AUDIT_REQUEST_BUDGET = 20 * time.Second
+	THUMBNAIL_SMALL = "small"
+	THUMBNAIL_MEDIUM = "medium"
+	THUMBNAIL_QUALITY = 80
+	MAX_THUMBNAIL_SOURCE_PIXELS = 64 * 1024 * 1024
+	SESSION_COOKIE = "tapp_session"
+	CSRF_COOKIE = "tapp_csrf"
+	API_TOKEN_PREFIX = "tapp_"
+	SCOPE_READ = "read"
+	SCOPE_ADMIN_DELETE = "admin:delete"
+	SCOPE_ADMIN_ARCHIVE = "admin:archive"
+	SCOPE_CRON = "cron"
+	SEARCH_DATE_FORMAT = "2006-01-02"
 	SEARCH_TIME_FORMAT = "Mon Jan 2 15:04:05 -0700 2006"
 	ARCHIVE_TIME_FORMAT = "2006-01-02 15:04:05 -0700"
 	XML_ATOM_TIME_FORMAT = "2006-01-02T15:04:05Z"
 	FEED_HEADER_FORMAT = "15:04:05 2006-01-02"
-	SUMMARY_LENGTH = 30
 	SECONDS_IN_DAY = int64(86400)
-	DAYS_BEFORE_UNRETWEET = 6
 )
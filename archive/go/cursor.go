@@ -0,0 +1,117 @@
+package tapp
+
+import (
+	"errors"
+	"strings"
+	"encoding/json"
+	"encoding/base64"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidPageSize = errors.New("invalid page size")
+)
+
+// TweetCursor is a keyset position in an ordered list of tweets: the sort
+// values of the tweet at the edge of a page. Unlike offsets it stays put when
+// new tweets are stored ahead of it.
+type TweetCursor struct {
+	// the order the cursor was made for, it is rejected for any other
+	Order string `json:"o"`
+	Id int64 `json:"i"`
+	Created int64 `json:"c,omitempty"`
+	Updated int64 `json:"u,omitempty"`
+	Faves int `json:"f,omitempty"`
+	Rts int `json:"r,omitempty"`
+	Ratio float32 `json:"a,omitempty"`
+	// relevance score, for ranked search results
+	Score float64 `json:"s,omitempty"`
+	// page backwards, to the tweets before the edge
+	Before bool `json:"b,omitempty"`
+}
+
+func newTweetCursor(tweet MyTweet, order []string, before bool) *TweetCursor {
+	return &TweetCursor{
+		Order: strings.Join(order, ","),
+		Id: tweet.Id,
+		Created: tweet.Created,
+		Updated: tweet.Updated,
+		Faves: tweet.Faves,
+		Rts: tweet.Rts,
+		Ratio: tweet.Ratio,
+		Before: before,
+	}
+}
+
+// ParseTweetCursor decodes a cursor token, checking it was made for order
+func ParseTweetCursor(token string, order []string) (*TweetCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	cursor := &TweetCursor{}
+	if err = json.Unmarshal(data, cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if cursor.Order != strings.Join(order, ",") {
+		return nil, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// String encodes the cursor as an opaque url safe token
+func (cursor TweetCursor) String() string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Edge is a tweet with the cursor's sort values, to compare others against
+func (cursor TweetCursor) Edge() MyTweet {
+	return MyTweet{
+		Id: cursor.Id,
+		Created: cursor.Created,
+		Updated: cursor.Updated,
+		Faves: cursor.Faves,
+		Rts: cursor.Rts,
+		Ratio: cursor.Ratio,
+	}
+}
+
+// Reverse is the cursor for the other direction from the same edge
+func (cursor TweetCursor) Reverse() *TweetCursor {
+	cursor.Before = cursor.Before == false
+	return &cursor
+}
+
+// cursorOrder makes order total by breaking ties on Id, ascending like the
+// datastore's own key order
+func cursorOrder(order []string) []string {
+	for _, o := range order {
+		if strings.TrimPrefix(o, "-") == "Id" {
+			return order
+		}
+	}
+	return append(append([]string{}, order...), "Id")
+}
+
+func reverseOrder(order []string) []string {
+	reversed := make([]string, len(order))
+	for i, o := range order {
+		if strings.HasPrefix(o, "-") {
+			reversed[i] = strings.TrimPrefix(o, "-")
+		} else {
+			reversed[i] = "-" + o
+		}
+	}
+	return reversed
+}
+
+// compareOrder compares two tweets by each property of order in turn
+func compareOrder(a MyTweet, b MyTweet, order []string) int {
+	for _, o := range order {
+		if c, _ := compareTweets(a, b, o); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
@@ -0,0 +1,704 @@
+package tapp
+
+import (
+	"fmt"
+	"sort"
+	"time"
+	"strconv"
+	"strings"
+	"context"
+	"unicode/utf8"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// datastoreStore is the App Engine Datastore backend
+type datastoreStore struct{}
+
+func (datastoreStore) GetTweet(ctx context.Context, id int64) (*MyTweet, error) {
+	tweet := MyTweet{Id: id}
+	if err := datastore.Get(ctx, tweet.GetKey(ctx), &tweet); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &tweet, nil
+}
+
+func (datastoreStore) GetTweets(ctx context.Context, ids []int64) ([]MyTweet, error) {
+	out := []MyTweet{}
+	for i := 0; i < len(ids); i += AppConfig.MaxPutSize {
+		sliced := ids[i:min(i + AppConfig.MaxPutSize, len(ids))]
+		keys := make([]*datastore.Key, len(sliced))
+		for j, id := range sliced {
+			keys[j] = MyTweet{Id: id}.GetKey(ctx)
+		}
+
+		tweets := make([]MyTweet, len(keys))
+		err := datastore.GetMulti(ctx, keys, tweets)
+		multi, isMulti := err.(appengine.MultiError)
+		if err != nil && isMulti == false {
+			return nil, err
+		}
+
+		for j, tweet := range tweets {
+			if isMulti && multi[j] != nil {
+				if multi[j] == datastore.ErrNoSuchEntity {
+					continue
+				}
+				return nil, multi[j]
+			}
+			out = append(out, tweet)
+		}
+	}
+	return out, nil
+}
+
+func (datastoreStore) GetLatestTweet(ctx context.Context, owner string) (*MyTweet, error) {
+	var tweets []MyTweet = []MyTweet{}
+	q := datastore.NewQuery("MyTweet").Filter("Owner =", owner).Limit(1).Order("-Id")
+
+	if _, err := q.GetAll(ctx, &tweets); err != nil {
+		return nil, err
+	}
+	if len(tweets) == 0 {
+		return nil, ErrNotFound
+	}
+	return &tweets[0], nil
+}
+
+func (datastoreStore) QueryTweets(ctx context.Context, query TweetQuery) ([]MyTweet, error) {
+	if query.Cursor != nil {
+		return queryTweetsFromCursor(ctx, query)
+	}
+
+	q := ownerQuery(query)
+	for _, order := range query.Order {
+		q = q.Order(order)
+	}
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit)
+	}
+	if query.Offset > 0 {
+		q = q.Offset(query.Offset)
+	}
+
+	tweets := []MyTweet{}
+	if _, err := q.GetAll(ctx, &tweets); err != nil {
+		return nil, err
+	}
+	return tweets, nil
+}
+
+// queryTweetsFromCursor reads the tweets past a keyset cursor. Datastore only
+// allows an inequality filter on the first sort property, so ties on it are
+// read and skipped here.
+func queryTweetsFromCursor(ctx context.Context, query TweetQuery) ([]MyTweet, error) {
+	order := cursorOrder(query.Order)
+	if query.Cursor.Before {
+		order = reverseOrder(order)
+	}
+	edge := query.Cursor.Edge()
+
+	q := ownerQuery(query)
+	field := strings.TrimPrefix(order[0], "-")
+	value, err := tweetField(edge, field)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(order[0], "-") {
+		q = q.Filter(field + " <=", value)
+	} else {
+		q = q.Filter(field + " >=", value)
+	}
+	for _, o := range order {
+		q = q.Order(o)
+	}
+
+	tweets := []MyTweet{}
+	skipped := 0
+	it := q.Run(ctx)
+	for query.Limit <= 0 || len(tweets) < query.Limit {
+		var tweet MyTweet
+		_, err := it.Next(&tweet)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if compareOrder(tweet, edge, order) <= 0 {
+			continue
+		}
+		if skipped < query.Offset {
+			skipped++
+			continue
+		}
+		tweets = append(tweets, tweet)
+	}
+
+	if query.Cursor.Before {
+		reverseTweets(tweets)
+	}
+	return tweets, nil
+}
+
+// ownerQuery starts a MyTweet query with the equality filters of a TweetQuery.
+// Tweets stored before accounts were tracked have no Owner, and match no
+// account here, until the /update/tweets or /migrate/owners job claims them
+// for the default account.
+func ownerQuery(query TweetQuery) *datastore.Query {
+	q := datastore.NewQuery("MyTweet")
+	if query.Owner != "" {
+		q = q.Filter("Owner =", query.Owner)
+	}
+	if query.IncludeDeleted == false {
+		q = q.Filter("Deleted =", false)
+	}
+	return q
+}
+
+// tweetField is the datastore value of a sortable tweet property
+func tweetField(tweet MyTweet, field string) (interface{}, error) {
+	switch field {
+	case "Id":
+		return tweet.Id, nil
+	case "Created":
+		return tweet.Created, nil
+	case "Updated":
+		return tweet.Updated, nil
+	case "Faves":
+		return int64(tweet.Faves), nil
+	case "Rts":
+		return int64(tweet.Rts), nil
+	case "Ratio":
+		return float64(tweet.Ratio), nil
+	}
+	return nil, fmt.Errorf("Error invalid order property: %q", field)
+}
+
+func (datastoreStore) PutTweets(ctx context.Context, tweets []MyTweet) error {
+	keys := []*datastore.Key{}
+	for _, tweet := range tweets {
+		keys = append(keys, tweet.GetKey(ctx))
+	}
+
+	length := len(keys)
+	for i := 0; i < length; i += AppConfig.MaxPutSize {
+		max := min(i + AppConfig.MaxPutSize, length)
+		slicedKeys := keys[i:max]
+		slicedTweets := tweets[i:max]
+		newKeys, err := datastore.PutMulti(ctx, slicedKeys, slicedTweets)
+		if err != nil {
+			return err
+		}
+		applog.Infof(ctx, "Saved tweets: %v", len(newKeys))
+	}
+	return nil
+}
+
+func (datastoreStore) CountTweets(ctx context.Context, owner string) (int, error) {
+	return ownerQuery(TweetQuery{Owner: owner}).KeysOnly().Count(ctx)
+}
+
+func (datastoreStore) GetUser(ctx context.Context, screenName string) (*User, error) {
+	user := User{ScreenName: screenName}
+	if err := datastore.Get(ctx, user.GetKey(ctx), &user); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (datastoreStore) ListUsers(ctx context.Context) ([]User, error) {
+	users := []User{}
+	if _, err := datastore.NewQuery("User").GetAll(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (datastoreStore) PutUser(ctx context.Context, user User) error {
+	newKey, err := datastore.Put(ctx, user.GetKey(ctx), &user)
+	if err != nil {
+		return err
+	}
+	applog.Infof(ctx, "Stored user: %v", newKey)
+	return nil
+}
+
+func userSnapshotKey(ctx context.Context, snapshot UserSnapshot) *datastore.Key {
+	return datastore.NewKey(ctx, "UserSnapshot", snapshot.Account + "/" + strconv.FormatInt(snapshot.Taken, 10), 0, nil)
+}
+
+func (datastoreStore) PutUserSnapshot(ctx context.Context, snapshot UserSnapshot) error {
+	_, err := datastore.Put(ctx, userSnapshotKey(ctx, snapshot), &snapshot)
+	return err
+}
+
+func (datastoreStore) ListUserSnapshots(ctx context.Context, account string) ([]UserSnapshot, error) {
+	snapshots := []UserSnapshot{}
+	q := datastore.NewQuery("UserSnapshot").Filter("Account =", strings.ToLower(account)).Order("Taken")
+	if _, err := q.GetAll(ctx, &snapshots); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+func apiTokenKey(ctx context.Context, id string) *datastore.Key {
+	return datastore.NewKey(ctx, "ApiToken", id, 0, nil)
+}
+
+func (datastoreStore) GetApiToken(ctx context.Context, id string) (*ApiToken, error) {
+	var token ApiToken
+	if err := datastore.Get(ctx, apiTokenKey(ctx, id), &token); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (datastoreStore) ListApiTokens(ctx context.Context) ([]ApiToken, error) {
+	tokens := []ApiToken{}
+	if _, err := datastore.NewQuery("ApiToken").Order("Created").GetAll(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (datastoreStore) PutApiToken(ctx context.Context, token ApiToken) error {
+	_, err := datastore.Put(ctx, apiTokenKey(ctx, token.Id), &token)
+	return err
+}
+
+func (datastoreStore) DeleteApiToken(ctx context.Context, id string) error {
+	return datastore.Delete(ctx, apiTokenKey(ctx, id))
+}
+
+func twitterAuthKey(ctx context.Context, screenName string) *datastore.Key {
+	return datastore.NewKey(ctx, "TwitterAuth", strings.ToLower(screenName), 0, nil)
+}
+
+func (datastoreStore) GetTwitterAuth(ctx context.Context, screenName string) (*TwitterAuth, error) {
+	var auth TwitterAuth
+	if err := datastore.Get(ctx, twitterAuthKey(ctx, screenName), &auth); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &auth, nil
+}
+
+func (datastoreStore) PutTwitterAuth(ctx context.Context, auth TwitterAuth) error {
+	_, err := datastore.Put(ctx, twitterAuthKey(ctx, auth.ScreenName), &auth)
+	return err
+}
+
+func adminSessionKey(ctx context.Context, id string) *datastore.Key {
+	return datastore.NewKey(ctx, "AdminSession", id, 0, nil)
+}
+
+func (datastoreStore) GetAdminSession(ctx context.Context, id string) (*AdminSession, error) {
+	var session AdminSession
+	if err := datastore.Get(ctx, adminSessionKey(ctx, id), &session); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (datastoreStore) PutAdminSession(ctx context.Context, session AdminSession) error {
+	_, err := datastore.Put(ctx, adminSessionKey(ctx, session.Id), &session)
+	return err
+}
+
+func (datastoreStore) DeleteAdminSession(ctx context.Context, id string) error {
+	return datastore.Delete(ctx, adminSessionKey(ctx, id))
+}
+
+func jobLeaseKey(ctx context.Context, name string) *datastore.Key {
+	return datastore.NewKey(ctx, "JobLease", name, 0, nil)
+}
+
+func (datastoreStore) AcquireJobLease(ctx context.Context, name string, holder string, expires int64) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		key := jobLeaseKey(tc, name)
+		lease := JobLease{Name: name}
+		if err := datastore.Get(tc, key, &lease); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if lease.heldByOther(holder, time.Now().Unix()) {
+			return ErrJobRunning
+		}
+		lease.Holder = holder
+		lease.Expires = expires
+		_, err := datastore.Put(tc, key, &lease)
+		return err
+	}, nil)
+}
+
+func (datastoreStore) ReleaseJobLease(ctx context.Context, released JobLease) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		key := jobLeaseKey(tc, released.Name)
+		var lease JobLease
+		if err := datastore.Get(tc, key, &lease); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if lease.Holder != released.Holder {
+			return nil
+		}
+		released.Holder = ""
+		released.Expires = 0
+		_, err := datastore.Put(tc, key, &released)
+		return err
+	}, nil)
+}
+
+func (datastoreStore) ListJobLeases(ctx context.Context) ([]JobLease, error) {
+	leases := []JobLease{}
+	if _, err := datastore.NewQuery("JobLease").GetAll(ctx, &leases); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+func mediaRefKey(ctx context.Context, path string) *datastore.Key {
+	return datastore.NewKey(ctx, "MediaRef", path, 0, nil)
+}
+
+func (datastoreStore) GetMediaRef(ctx context.Context, path string) (*MediaRef, error) {
+	var ref MediaRef
+	if err := datastore.Get(ctx, mediaRefKey(ctx, path), &ref); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &ref, nil
+}
+
+func (datastoreStore) ListMediaRefs(ctx context.Context) ([]MediaRef, error) {
+	refs := []MediaRef{}
+	if _, err := datastore.NewQuery("MediaRef").GetAll(ctx, &refs); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func (datastoreStore) PutMediaRef(ctx context.Context, ref MediaRef) error {
+	_, err := datastore.Put(ctx, mediaRefKey(ctx, ref.Path), &ref)
+	return err
+}
+
+func mediaDownloadKey(ctx context.Context, path string) *datastore.Key {
+	return datastore.NewKey(ctx, "MediaDownload", path, 0, nil)
+}
+
+func (datastoreStore) ListMediaDownloads(ctx context.Context) ([]MediaDownload, error) {
+	downloads := []MediaDownload{}
+	if _, err := datastore.NewQuery("MediaDownload").Order("NextAttempt").GetAll(ctx, &downloads); err != nil {
+		return nil, err
+	}
+	return downloads, nil
+}
+
+func (datastoreStore) PutMediaDownload(ctx context.Context, download MediaDownload) error {
+	_, err := datastore.Put(ctx, mediaDownloadKey(ctx, download.Path), &download)
+	return err
+}
+
+func (datastoreStore) DeleteMediaDownload(ctx context.Context, path string) error {
+	return datastore.Delete(ctx, mediaDownloadKey(ctx, path))
+}
+
+// the latest media audit is the only one kept
+func mediaAuditKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, "MediaAudit", "latest", 0, nil)
+}
+
+func (datastoreStore) GetMediaAudit(ctx context.Context) (*MediaAudit, error) {
+	var audit MediaAudit
+	if err := datastore.Get(ctx, mediaAuditKey(ctx), &audit); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &audit, nil
+}
+
+func (datastoreStore) PutMediaAudit(ctx context.Context, audit MediaAudit) error {
+	_, err := datastore.Put(ctx, mediaAuditKey(ctx), &audit)
+	return err
+}
+
+// indexTermEntity is how an IndexTerm is kept in datastore, keyed by token.
+// Its postings are split by postingShard into indexShardEntity children, so a
+// common token grows by entity rather than outgrowing one
+type indexTermEntity struct {
+	Shards []int64 `datastore:",noindex"`
+	// postings kept before the index was sharded, moved into shards the next
+	// time the term is updated
+	Postings []byte `datastore:",noindex"`
+}
+
+type indexShardEntity struct {
+	Postings []byte `datastore:",noindex"`
+}
+
+func indexTermKey(ctx context.Context, token string) *datastore.Key {
+	return datastore.NewKey(ctx, "IndexTerm", token, 0, nil)
+}
+
+// indexShardKey is offset by one, a zero id would make an incomplete key
+func indexShardKey(ctx context.Context, term *datastore.Key, shard int64) *datastore.Key {
+	return datastore.NewKey(ctx, "IndexShard", "", shard + 1, term)
+}
+
+func (datastoreStore) GetTerms(ctx context.Context, tokens []string) ([]IndexTerm, error) {
+	terms := []IndexTerm{}
+	for i := 0; i < len(tokens); i += AppConfig.MaxPutSize {
+		sliced := tokens[i:min(i + AppConfig.MaxPutSize, len(tokens))]
+		keys := make([]*datastore.Key, len(sliced))
+		for j, token := range sliced {
+			keys[j] = indexTermKey(ctx, token)
+		}
+
+		entities := make([]indexTermEntity, len(keys))
+		err := datastore.GetMulti(ctx, keys, entities)
+		multi, isMulti := err.(appengine.MultiError)
+		if err != nil && isMulti == false {
+			return nil, err
+		}
+
+		for j, entity := range entities {
+			if isMulti && multi[j] != nil {
+				if multi[j] == datastore.ErrNoSuchEntity {
+					continue
+				}
+				return nil, multi[j]
+			}
+			postings, err := decodePostings(entity.Postings)
+			if err != nil {
+				return nil, err
+			}
+			shards, err := getIndexShards(ctx, keys[j], entity.Shards)
+			if err != nil {
+				return nil, err
+			}
+			for _, shard := range shards {
+				postings = append(postings, shard...)
+			}
+			terms = append(terms, IndexTerm{Token: sliced[j], Postings: sortPostings(postings)})
+		}
+	}
+	return terms, nil
+}
+
+// getIndexShards returns the postings of the given shards of a term
+func getIndexShards(ctx context.Context, term *datastore.Key, shards []int64) (map[int64][]Posting, error) {
+	postings := map[int64][]Posting{}
+	for i := 0; i < len(shards); i += AppConfig.MaxPutSize {
+		sliced := shards[i:min(i + AppConfig.MaxPutSize, len(shards))]
+		keys := make([]*datastore.Key, len(sliced))
+		for j, shard := range sliced {
+			keys[j] = indexShardKey(ctx, term, shard)
+		}
+		entities := make([]indexShardEntity, len(keys))
+		if err := datastore.GetMulti(ctx, keys, entities); err != nil {
+			return nil, err
+		}
+		for j, entity := range entities {
+			decoded, err := decodePostings(entity.Postings)
+			if err != nil {
+				return nil, err
+			}
+			postings[sliced[j]] = decoded
+		}
+	}
+	return postings, nil
+}
+
+func (datastoreStore) ListTokens(ctx context.Context, prefix string, limit int) ([]string, error) {
+	q := datastore.NewQuery("IndexTerm").KeysOnly().Order("__key__")
+	if prefix != "" {
+		q = q.Filter("__key__ >=", indexTermKey(ctx, prefix)).
+			Filter("__key__ <", indexTermKey(ctx, prefix + string(utf8.MaxRune)))
+	}
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	keys, err := q.GetAll(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]string, len(keys))
+	for i, key := range keys {
+		tokens[i] = key.StringID()
+	}
+	return tokens, nil
+}
+
+func (datastoreStore) UpdateTerms(ctx context.Context, updates []TermUpdate) ([]string, error) {
+	changed := []string{}
+	for _, update := range updates {
+		// a term and its shards are one entity group, so each term is its
+		// own transaction
+		var existed, exists bool
+		err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+			key := indexTermKey(tc, update.Token)
+			var term indexTermEntity
+			err := datastore.Get(tc, key, &term)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			existed = err == nil
+
+			// only the shards the update touches are read and written
+			touched := map[int64]bool{}
+			for _, id := range update.Removed {
+				touched[postingShard(id)] = true
+			}
+			for _, posting := range update.Added {
+				touched[postingShard(posting.TweetId)] = true
+			}
+			legacy, err := decodePostings(term.Postings)
+			if err != nil {
+				return err
+			}
+			for _, posting := range legacy {
+				touched[postingShard(posting.TweetId)] = true
+			}
+			stored := []int64{}
+			for _, shard := range term.Shards {
+				if touched[shard] {
+					stored = append(stored, shard)
+				}
+			}
+			shards, err := getIndexShards(tc, key, stored)
+			if err != nil {
+				return err
+			}
+
+			postings := legacy
+			for _, shard := range shards {
+				postings = append(postings, shard...)
+			}
+			regrouped := map[int64][]Posting{}
+			for _, posting := range update.apply(postings) {
+				shard := postingShard(posting.TweetId)
+				regrouped[shard] = append(regrouped[shard], posting)
+			}
+
+			keys := []*datastore.Key{}
+			entities := []indexShardEntity{}
+			deleted := []*datastore.Key{}
+			for shard := range touched {
+				if len(regrouped[shard]) > 0 {
+					keys = append(keys, indexShardKey(tc, key, shard))
+					entities = append(entities, indexShardEntity{Postings: encodePostings(regrouped[shard])})
+				} else if _, ok := shards[shard]; ok {
+					deleted = append(deleted, indexShardKey(tc, key, shard))
+				}
+			}
+			term.Postings = nil
+			kept := []int64{}
+			for _, shard := range term.Shards {
+				if touched[shard] == false {
+					kept = append(kept, shard)
+				}
+			}
+			for shard := range regrouped {
+				kept = append(kept, shard)
+			}
+			sort.Slice(kept, func(i, j int) bool {
+				return kept[i] < kept[j]
+			})
+			term.Shards = kept
+			exists = len(kept) > 0
+
+			if len(keys) > 0 {
+				if _, err = datastore.PutMulti(tc, keys, entities); err != nil {
+					return err
+				}
+			}
+			if len(deleted) > 0 {
+				if err = datastore.DeleteMulti(tc, deleted); err != nil {
+					return err
+				}
+			}
+			if exists == false {
+				if existed {
+					return datastore.Delete(tc, key)
+				}
+				return nil
+			}
+			_, err = datastore.Put(tc, key, &term)
+			return err
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if existed != exists {
+			changed = append(changed, update.Token)
+		}
+	}
+	return changed, nil
+}
+
+func (datastoreStore) ClearTerms(ctx context.Context) error {
+	for _, kind := range []string{"IndexShard", "IndexTerm"} {
+		keys, err := datastore.NewQuery(kind).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err = deleteKeys(ctx, keys); err != nil {
+			return err
+		}
+	}
+	_, err := datastore.Put(ctx, indexStatsKey(ctx), &IndexStats{})
+	return err
+}
+
+func indexStatsKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, "IndexStats", "stats", 0, nil)
+}
+
+func (datastoreStore) GetStats(ctx context.Context) (IndexStats, error) {
+	var stats IndexStats
+	err := datastore.Get(ctx, indexStatsKey(ctx), &stats)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return stats, err
+	}
+	return stats, nil
+}
+
+func (datastoreStore) AddStats(ctx context.Context, delta IndexStats) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var stats IndexStats
+		key := indexStatsKey(tc)
+		if err := datastore.Get(tc, key, &stats); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		stats.Docs += delta.Docs
+		stats.Tokens += delta.Tokens
+		_, err := datastore.Put(tc, key, &stats)
+		return err
+	}, nil)
+}
+
+func deleteKeys(ctx context.Context, keys []*datastore.Key) error {
+	for i := 0; i < len(keys); i += AppConfig.MaxPutSize {
+		if err := datastore.DeleteMulti(ctx, keys[i:min(i + AppConfig.MaxPutSize, len(keys))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package tapp
+
+import (
+	"io"
+	"fmt"
+	"sync"
+	"strconv"
+	"context"
+	"google.golang.org/api/iterator"
+	"google.golang.org/appengine/file"
+	"cloud.google.com/go/storage"
+)
+
+// gcsBlobStore keeps blobs in a google cloud storage bucket, the App Engine
+// default bucket when none is configured
+type gcsBlobStore struct {
+	mu sync.Mutex
+	bucket string
+	// made on first use and shared, it pools its connections
+	client *storage.Client
+}
+
+func (s *gcsBlobStore) getBucket(ctx context.Context) (*storage.BucketHandle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		// the client refreshes its credentials with this context, so it
+		// can't end with the request
+		client, err := storage.NewClient(context.WithoutCancel(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("Error getting storage.Client: %v", err)
+		}
+		s.client = client
+	}
+	if s.bucket == "" {
+		bucketName, err := file.DefaultBucketName(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting default bucket name: %v", err)
+		}
+		s.bucket = bucketName
+	}
+
+	return s.client.Bucket(s.bucket), nil
+}
+
+func (s *gcsBlobStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
+
+func (s *gcsBlobStore) Put(ctx context.Context, name string, r io.Reader, contentType string) error {
+	if validBlobName(name) == false {
+		return ErrInvalidBlobName
+	}
+	bucket, err := s.getBucket(ctx)
+	if err != nil {
+		return err
+	}
+	wc := bucket.Object(name).NewWriter(ctx)
+	wc.ContentType = contentType
+	if _, err = io.Copy(wc, r); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+func (s *gcsBlobStore) Get(ctx context.Context, name string) (io.ReadSeekCloser, *BlobInfo, error) {
+	if validBlobName(name) == false {
+		return nil, nil, ErrInvalidBlobName
+	}
+	bucket, err := s.getBucket(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj := bucket.Object(name)
+	rc, err := obj.NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	info := &BlobInfo{
+		Name: name,
+		Size: rc.Attrs.Size,
+		ContentType: rc.Attrs.ContentType,
+		Updated: rc.Attrs.LastModified,
+		// a new generation is written whenever the object changes
+		ETag: strconv.FormatInt(rc.Attrs.Generation, 10),
+	}
+	// pin the generation read so a seek never mixes in a newer object
+	obj = obj.Generation(rc.Attrs.Generation)
+	return &gcsBlobReader{ctx: ctx, obj: obj, size: info.Size, rc: rc}, info, nil
+}
+
+// gcsBlobReader seeks by opening a new range reader at the offset when the
+// next read comes
+type gcsBlobReader struct {
+	ctx context.Context
+	obj *storage.ObjectHandle
+	size int64
+	offset int64
+	// rc reads from pos
+	rc *storage.Reader
+	pos int64
+}
+
+func (r *gcsBlobReader) Read(p []byte) (int, error) {
+	if r.rc != nil && r.pos != r.offset {
+		r.rc.Close()
+		r.rc = nil
+	}
+	if r.rc == nil {
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+		rc, err := r.obj.NewRangeReader(r.ctx, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+		r.pos = r.offset
+	}
+	n, err := r.rc.Read(p)
+	r.offset += int64(n)
+	r.pos = r.offset
+	return n, err
+}
+
+func (r *gcsBlobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Error seeking blob: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *gcsBlobReader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	return r.rc.Close()
+}
+
+func (s *gcsBlobStore) Stat(ctx context.Context, name string) (*BlobInfo, error) {
+	if validBlobName(name) == false {
+		return nil, ErrInvalidBlobName
+	}
+	bucket, err := s.getBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := bucket.Object(name).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	info := gcsBlobInfo(attrs)
+	return &info, nil
+}
+
+func (s *gcsBlobStore) Delete(ctx context.Context, name string) error {
+	if validBlobName(name) == false {
+		return ErrInvalidBlobName
+	}
+	bucket, err := s.getBucket(ctx)
+	if err != nil {
+		return err
+	}
+	err = bucket.Object(name).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (s *gcsBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	bucket, err := s.getBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	infos := []BlobInfo{}
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Error listing bucket: %v", err)
+		}
+		infos = append(infos, gcsBlobInfo(attrs))
+	}
+	return infos, nil
+}
+
+func gcsBlobInfo(attrs *storage.ObjectAttrs) BlobInfo {
+	return BlobInfo{
+		Name: attrs.Name,
+		Size: attrs.Size,
+		ContentType: attrs.ContentType,
+		Updated: attrs.Updated,
+		ETag: strconv.FormatInt(attrs.Generation, 10),
+	}
+}
@@ -0,0 +1,115 @@
+package tapp
+
+import (
+	"fmt"
+	"strings"
+	"net/http"
+	"html/template"
+	"encoding/json"
+)
+
+// HttpError is an error a handler returns to have appHandler answer with
+// Status instead of a 500. Msg is shown to the client, Err is only logged.
+type HttpError struct {
+	Status int
+	Msg string
+	Err error
+	// methods for the Allow header of a 405
+	Allow []string
+}
+
+func (err *HttpError) Error() string {
+	if err.Err != nil {
+		return fmt.Sprintf("%v %v: %v", err.Status, err.Msg, err.Err)
+	}
+	return fmt.Sprintf("%v %v", err.Status, err.Msg)
+}
+
+func (err *HttpError) Unwrap() error {
+	return err.Err
+}
+
+func NotFound(format string, args ...interface{}) *HttpError {
+	return &HttpError{Status: http.StatusNotFound, Msg: fmt.Sprintf(format, args...)}
+}
+
+func BadRequest(format string, args ...interface{}) *HttpError {
+	return &HttpError{Status: http.StatusBadRequest, Msg: fmt.Sprintf(format, args...)}
+}
+
+func Unauthorized(format string, args ...interface{}) *HttpError {
+	return &HttpError{Status: http.StatusUnauthorized, Msg: fmt.Sprintf(format, args...)}
+}
+
+func MethodNotAllowed(method string, allow ...string) *HttpError {
+	return &HttpError{
+		Status: http.StatusMethodNotAllowed,
+		Msg: fmt.Sprintf("method %v not allowed", method),
+		Allow: allow,
+	}
+}
+
+// Upstream is a failure of a service tapp depends on, e.g. Twitter or
+// cloud storage
+func Upstream(err error, format string, args ...interface{}) *HttpError {
+	return &HttpError{Status: http.StatusBadGateway, Msg: fmt.Sprintf(format, args...), Err: err}
+}
+
+// problemDetails is the RFC 7807 JSON body of an error response
+type problemDetails struct {
+	Type string `json:"type"`
+	Title string `json:"title"`
+	Status int `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Instance string `json:"instance"`
+}
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<div id="error">
+  <div></div>
+  <div id="err-message">{{.Status}} {{.Title}} :(</div>
+  <div>{{.Detail}}</div>
+</div>
+</body>
+</html>
+`))
+
+// writeHttpError answers with err as problem details JSON, or as the error
+// page when the client prefers HTML, with err's status either way
+func writeHttpError(w http.ResponseWriter, r *http.Request, err *HttpError) {
+	problem := problemDetails{
+		Type: "about:blank",
+		Title: http.StatusText(err.Status),
+		Status: err.Status,
+		Detail: err.Msg,
+		Instance: r.URL.Path,
+	}
+	if len(err.Allow) > 0 {
+		w.Header().Set("Allow", strings.Join(err.Allow, ", "))
+	}
+
+	if prefersHtml(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(err.Status)
+		errorPage.Execute(w, problem)
+		return
+	}
+
+	body, _ := json.Marshal(problem)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(err.Status)
+	w.Write(body)
+}
+
+// prefersHtml reports whether accept lists text/html ahead of any JSON type
+func prefersHtml(accept string) bool {
+	html := strings.Index(accept, "text/html")
+	if html < 0 {
+		return false
+	}
+	jsonType := strings.Index(accept, "json")
+	return jsonType < 0 || html < jsonType
+}
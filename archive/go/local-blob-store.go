@@ -0,0 +1,167 @@
+package tapp
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// LocalBlobStore keeps blobs as files under a directory. Files carry no
+// metadata, so content types come from the name's extension.
+type LocalBlobStore struct {
+	dir string
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("Error no media directory configured")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating media directory %q: %v", dir, err)
+	}
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+func (s *LocalBlobStore) path(name string) (string, error) {
+	if validBlobName(name) == false {
+		return "", ErrInvalidBlobName
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+// Put writes to a temporary file renamed into place, so readers never see a
+// partial blob
+func (s *LocalBlobStore) Put(ctx context.Context, name string, r io.Reader, contentType string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), filepath.Base(p) + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, name string) (io.ReadSeekCloser, *BlobInfo, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, nil, ErrBlobNotFound
+	}
+	info := localBlobInfo(name, fi)
+	return f, &info, nil
+}
+
+func (s *LocalBlobStore) Stat(ctx context.Context, name string) (*BlobInfo, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) || (err == nil && fi.IsDir()) {
+		return nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	info := localBlobInfo(name, fi)
+	return &info, nil
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (s *LocalBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	// only walk the directory the prefix ends in
+	root := s.dir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		if validBlobName(prefix[:i]) == false {
+			return nil, ErrInvalidBlobName
+		}
+		root = filepath.Join(s.dir, filepath.FromSlash(prefix[:i]))
+	}
+
+	infos := []BlobInfo{}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || strings.Contains(fi.Name(), ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			infos = append(infos, localBlobInfo(name, fi))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing media directory: %v", err)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+// Close has nothing to release, files are opened per call
+func (s *LocalBlobStore) Close() error {
+	return nil
+}
+
+func localBlobInfo(name string, fi os.FileInfo) BlobInfo {
+	return BlobInfo{
+		Name: name,
+		Size: fi.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(name)),
+		Updated: fi.ModTime(),
+		ETag: fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size()),
+	}
+}
@@ -0,0 +1,287 @@
+package tapp
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"context"
+	"net/http"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// MediaProblem is a stored media file the audit found broken, referenced by
+// a tweet or, for avatars, a user
+type MediaProblem struct {
+	TweetId int64
+	ScreenName string
+	Path string
+	Problem string
+	Repaired bool
+	Error string
+}
+
+// MediaAudit is an audit's report and progress, kept in the store while it
+// works through the tweets a batch at a time
+type MediaAudit struct {
+	Started int64
+	// zero until every batch is done
+	Finished int64
+	Repair bool
+	// id of the last tweet audited, the next batch starts after it
+	Cursor int64
+	Checked int
+	// files skipped while they wait in the download retry queue
+	Queued int
+	ProblemCount int
+	RepairedCount int
+	// the first MEDIA_AUDIT_MAX_PROBLEMS problems, so the audit stays well
+	// under the datastore entity size limit however much is broken
+	Problems []MediaProblem `datastore:",noindex"`
+}
+
+func newMediaAudit(repair bool) *MediaAudit {
+	return &MediaAudit{Started: time.Now().Unix(), Repair: repair, Problems: []MediaProblem{}}
+}
+
+// mediaAuditHandler shows the latest audit on GET. POST starts a new one,
+// re-downloading the broken files with ?repair=true, and audits what it can
+// in the request; the /audit/media job carries on with the rest.
+func mediaAuditHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var audit *MediaAudit
+	status := http.StatusOK
+	if r.Method == "GET" {
+		var err error
+		audit, err = MediaRefStorage.GetMediaAudit(ctx)
+		if err == ErrNotFound {
+			return NotFound("No media audit has run yet")
+		} else if err != nil {
+			return fmt.Errorf("Error getting media audit: %v", err)
+		}
+	} else if r.Method == "POST" {
+		audit = newMediaAudit(r.URL.Query().Get("repair") == "true")
+		err := Jobs.RunAs(ctx, "/audit/media", func(ctx context.Context) error {
+			return runMediaAudit(ctx, audit, MEDIA_AUDIT_REQUEST_BUDGET)
+		})
+		if err == ErrJobRunning {
+			return &HttpError{Status: http.StatusConflict, Msg: "A media audit is running, try again once it's done"}
+		} else if err != nil {
+			return fmt.Errorf("Error auditing media: %v", err)
+		}
+		if audit.Finished == 0 {
+			status = http.StatusAccepted
+		}
+	} else {
+		return MethodNotAllowed(r.Method, "GET", "POST")
+	}
+
+	auditJson, err := json.Marshal(audit)
+	if err != nil {
+		return fmt.Errorf("Error marshaling json for media audit: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, err = w.Write(auditJson)
+	return err
+}
+
+// continueMediaAudit is the /audit/media job. It carries on with an
+// unfinished audit, or starts a repairing one when the last is
+// MEDIA_AUDIT_INTERVAL old.
+func continueMediaAudit(ctx context.Context) error {
+	audit, err := MediaRefStorage.GetMediaAudit(ctx)
+	if err == ErrNotFound {
+		audit = newMediaAudit(true)
+	} else if err != nil {
+		return fmt.Errorf("Error getting media audit: %v", err)
+	} else if audit.Finished != 0 {
+		if time.Since(time.Unix(audit.Started, 0)) < MEDIA_AUDIT_INTERVAL {
+			return nil
+		}
+		audit = newMediaAudit(true)
+	}
+	return runMediaAudit(ctx, audit, MEDIA_AUDIT_JOB_BUDGET)
+}
+
+// runMediaAudit audits batches of tweets until audit is finished or budget
+// is spent, storing its progress after each
+func runMediaAudit(ctx context.Context, audit *MediaAudit, budget time.Duration) error {
+	deadline := time.Now().Add(budget)
+	downloads, err := MediaRefStorage.ListMediaDownloads(ctx)
+	if err != nil {
+		return fmt.Errorf("Error listing media downloads: %v", err)
+	}
+	queued := map[string]bool{}
+	for _, download := range downloads {
+		queued[download.Path] = true
+	}
+
+	for audit.Finished == 0 && time.Now().Before(deadline) {
+		if err = auditMediaBatch(ctx, audit, queued); err != nil {
+			return err
+		}
+		if err = MediaRefStorage.PutMediaAudit(ctx, *audit); err != nil {
+			return fmt.Errorf("Error storing media audit: %v", err)
+		}
+	}
+	return nil
+}
+
+// auditMediaBatch checks the media of the MEDIA_AUDIT_BATCH tweets after the
+// audit's cursor, and once past the last tweet the users' avatars. With
+// repair the broken files are downloaded again, if twitter still serves
+// them.
+func auditMediaBatch(ctx context.Context, audit *MediaAudit, queued map[string]bool) error {
+	query := TweetQuery{IncludeDeleted: true, Order: []string{"Id"}, Limit: MEDIA_AUDIT_BATCH}
+	if audit.Cursor > 0 {
+		query.Cursor = &TweetCursor{Order: "Id", Id: audit.Cursor}
+	}
+	tweets, err := TweetStorage.QueryTweets(ctx, query)
+	if err != nil {
+		return fmt.Errorf("Error getting tweets: %v", err)
+	}
+	changed := []MyTweet{}
+	for _, tweet := range tweets {
+		updated := false
+		for i := range tweet.Media {
+			if audit.checkMedia(ctx, &tweet.Media[i], queued, MediaProblem{TweetId: tweet.Id}) {
+				updated = true
+			}
+		}
+		if updated {
+			changed = append(changed, tweet)
+		}
+		audit.Cursor = tweet.Id
+	}
+	if len(changed) > 0 {
+		if err = TweetStorage.PutTweets(ctx, changed); err != nil {
+			return fmt.Errorf("Error storing repaired tweets: %v", err)
+		}
+	}
+	if len(tweets) == MEDIA_AUDIT_BATCH {
+		return nil
+	}
+
+	users, err := UserStorage.ListUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("Error getting users: %v", err)
+	}
+	for _, user := range users {
+		if audit.checkMedia(ctx, &user.Media, queued, MediaProblem{ScreenName: user.ScreenName}) {
+			if err = UserStorage.PutUser(ctx, user); err != nil {
+				return fmt.Errorf("Error storing repaired user: %v", err)
+			}
+		}
+	}
+
+	audit.Finished = time.Now().Unix()
+	applog.Infof(ctx, "media audit: %v checked, %v queued, %v problems, %v repaired", audit.Checked, audit.Queued, audit.ProblemCount, audit.RepairedCount)
+	return nil
+}
+
+// checkMedia audits m's file and its poster, recording what's broken, and
+// tells whether repairing changed m
+func (audit *MediaAudit) checkMedia(ctx context.Context, m *Media, queued map[string]bool, owner MediaProblem) bool {
+	files := [][2]string{{m.UploadFileName, m.MediaUrl}}
+	if m.PosterFileName != "" {
+		files = append(files, [2]string{m.PosterFileName, m.PosterUrl})
+	}
+
+	updated := false
+	for i, file := range files {
+		filePath, sourceUrl := file[0], file[1]
+		if filePath == "" {
+			continue
+		}
+		if queued[filePath] {
+			audit.Queued++
+			continue
+		}
+		audit.Checked++
+
+		problem, err := checkMediaFile(ctx, filePath)
+		if err != nil {
+			problem = MEDIA_UNREADABLE
+		} else if problem == "" {
+			continue
+		}
+		applog.Warningf(ctx, "media audit: %v is %v", filePath, problem)
+
+		found := owner
+		found.Path = filePath
+		found.Problem = problem
+		if err != nil {
+			found.Error = err.Error()
+		} else if audit.Repair && sourceUrl != "" {
+			stored := Media{MediaUrl: sourceUrl, UploadFileName: filePath}
+			if err = downloadMediaFile(ctx, &stored, true); err != nil {
+				found.Error = err.Error()
+			} else {
+				found.Repaired = true
+				// the poster isn't recorded beyond its path
+				if i == 0 {
+					m.Hash = stored.Hash
+					m.Size = stored.Size
+					m.ContentType = stored.ContentType
+					m.SmallFileName = stored.SmallFileName
+					m.MediumFileName = stored.MediumFileName
+					updated = true
+				}
+			}
+		}
+		audit.ProblemCount++
+		if found.Repaired {
+			audit.RepairedCount++
+		}
+		if len(audit.Problems) < MEDIA_AUDIT_MAX_PROBLEMS {
+			audit.Problems = append(audit.Problems, found)
+		}
+	}
+	return updated
+}
+
+// checkMediaFile returns what's wrong with the file stored for filePath, if
+// anything. Content addressed files are read through to check their hash,
+// those stored before only that they exist and aren't empty.
+func checkMediaFile(ctx context.Context, filePath string) (string, error) {
+	name, hash := filePath, ""
+	ref, err := MediaRefStorage.GetMediaRef(ctx, filePath)
+	if err == nil {
+		name, hash = mediaBlobName(ref.Hash), ref.Hash
+	} else if err != ErrNotFound {
+		return "", err
+	}
+
+	if hash == "" {
+		info, err := MediaStorage.Stat(ctx, name)
+		if err == ErrBlobNotFound {
+			return MEDIA_MISSING, nil
+		} else if err != nil {
+			return "", err
+		}
+		if info.Size == 0 {
+			return MEDIA_EMPTY, nil
+		}
+		return "", nil
+	}
+
+	rc, info, err := MediaStorage.Get(ctx, name)
+	if err == ErrBlobNotFound {
+		return MEDIA_MISSING, nil
+	} else if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if info.Size == 0 {
+		return MEDIA_EMPTY, nil
+	}
+	sum := sha256.New()
+	if _, err = io.Copy(sum, rc); err != nil {
+		return "", err
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != hash {
+		return MEDIA_HASH_MISMATCH, nil
+	}
+	return "", nil
+}
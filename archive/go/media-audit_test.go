@@ -0,0 +1,82 @@
+package tapp
+
+import (
+	"time"
+	"strconv"
+	"context"
+	"testing"
+	"net/http"
+)
+
+func TestMediaAuditBatches(t *testing.T) {
+	mux := newTestRouter(t)
+	ctx := context.Background()
+	tweets := []MyTweet{}
+	for i := 1; i <= MEDIA_AUDIT_BATCH + 50; i++ {
+		id := strconv.Itoa(i)
+		tweets = append(tweets, MyTweet{Id: int64(i), IdStr: id, Owner: "alice", Media: []Media{{UploadFileName: "status/" + id + "/photo/0.jpg"}}})
+	}
+	if err := TweetStorage.PutTweets(ctx, tweets); err != nil {
+		t.Fatalf("Error storing tweets: %v", err)
+	}
+
+	// one batch, as a request or job that ran out of time leaves it
+	audit := newMediaAudit(false)
+	if err := auditMediaBatch(ctx, audit, nil); err != nil {
+		t.Fatalf("Error auditing batch: %v", err)
+	}
+	if audit.Finished != 0 || audit.Cursor != MEDIA_AUDIT_BATCH || audit.Checked != MEDIA_AUDIT_BATCH {
+		t.Fatalf("audit after a batch = finished %v, cursor %v, checked %v", audit.Finished, audit.Cursor, audit.Checked)
+	}
+	if err := MediaRefStorage.PutMediaAudit(ctx, *audit); err != nil {
+		t.Fatalf("Error storing audit: %v", err)
+	}
+
+	// the job carries on from the cursor
+	if err := Jobs.Run(ctx, "/audit/media"); err != nil {
+		t.Fatalf("Error running /audit/media: %v", err)
+	}
+	stored, err := MediaRefStorage.GetMediaAudit(ctx)
+	if err != nil {
+		t.Fatalf("Error getting audit: %v", err)
+	}
+	if stored.Finished == 0 || stored.Repair || stored.Checked != len(tweets) || stored.ProblemCount != len(tweets) || len(stored.Problems) != len(tweets) {
+		t.Errorf("audit after the job = finished %v, repair %v, checked %v, problems %v listed %v", stored.Finished, stored.Repair, stored.Checked, stored.ProblemCount, len(stored.Problems))
+	}
+
+	// a finished audit is only started again once it's old
+	if err = Jobs.Run(ctx, "/audit/media"); err != nil {
+		t.Fatalf("Error running /audit/media: %v", err)
+	}
+	if again, _ := MediaRefStorage.GetMediaAudit(ctx); again.Started != stored.Started {
+		t.Errorf("a recent audit was started again")
+	}
+
+	var shown MediaAudit
+	decodeBody(t, serve(mux, "GET", "/admin/media/audit", "Authorization", "Bearer " + testAdminToken), &shown)
+	if shown.Finished != stored.Finished || len(shown.Problems) != len(tweets) {
+		t.Errorf("GET /admin/media/audit = finished %v, problems %v", shown.Finished, len(shown.Problems))
+	}
+
+	// a request can't start one while a batch runs elsewhere
+	if err = JobStorage.AcquireJobLease(ctx, "/audit/media", "other", time.Now().Add(time.Minute).Unix()); err != nil {
+		t.Fatalf("Error taking lease: %v", err)
+	}
+	w := serve(mux, "POST", "/admin/media/audit", "Authorization", "Bearer " + testAdminToken, "Accept", "application/json")
+	if w.Code != http.StatusConflict {
+		t.Errorf("POST /admin/media/audit while running: %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestMediaAuditProblemCap(t *testing.T) {
+	newTestRouter(t)
+	ctx := context.Background()
+	audit := newMediaAudit(false)
+	for i := 0; i <= MEDIA_AUDIT_MAX_PROBLEMS; i++ {
+		m := Media{UploadFileName: "status/" + strconv.Itoa(i) + "/photo/0.jpg"}
+		audit.checkMedia(ctx, &m, nil, MediaProblem{TweetId: int64(i)})
+	}
+	if audit.ProblemCount != MEDIA_AUDIT_MAX_PROBLEMS + 1 || len(audit.Problems) != MEDIA_AUDIT_MAX_PROBLEMS {
+		t.Errorf("audit over the cap = %v problems, %v listed", audit.ProblemCount, len(audit.Problems))
+	}
+}
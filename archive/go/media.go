@@ -1,10 +1,252 @@
 package tapp
 
+import (
+	"io"
+	"os"
+	"fmt"
+	"mime"
+	"path"
+	"time"
+	"strings"
+	"context"
+	"net/http"
+	"io/ioutil"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
 type Media struct {
 	IdStr string
 	Url string
 	ExpandedUrl string
 	Type string
 	MediaUrl string
+	// the path served at /media?file=
 	UploadFileName string
+	// sha256 hex of the stored content, empty until it's downloaded
+	Hash string
+	Size int64
+	ContentType string
+	// of the largest size twitter serves
+	Width int
+	Height int
+	// of videos and animated gifs, the archived mp4 variant's bitrate and the
+	// path and url of the still shown before playing
+	Bitrate int
+	DurationMillis int64
+	PosterFileName string
+	PosterUrl string
+	// scaled down jpegs of images, empty for sizes the image is no larger
+	// than, served at /media?file=UploadFileName&size=
+	SmallFileName string
+	MediumFileName string
+}
+
+// MediaRef points a media path at the content addressed blob holding it, so
+// an image posted again is only stored once
+type MediaRef struct {
+	Path string
+	Hash string
+	Size int64
+	ContentType string
+	Updated int64
+}
+
+// MediaDownload is a media file that failed to download, waiting for
+// another attempt
+type MediaDownload struct {
+	Path string
+	Url string
+	// tweet whose Media is updated once it's stored, 0 for avatars
+	TweetId int64
+	Attempts int
+	NextAttempt int64
+	LastError string `datastore:",noindex"`
+	Created int64
+}
+
+// MediaRefStore persists the media references, keyed by path, and the
+// download retry queue
+type MediaRefStore interface {
+	GetMediaRef(ctx context.Context, path string) (*MediaRef, error)
+	ListMediaRefs(ctx context.Context) ([]MediaRef, error)
+	PutMediaRef(ctx context.Context, ref MediaRef) error
+	ListMediaDownloads(ctx context.Context) ([]MediaDownload, error)
+	PutMediaDownload(ctx context.Context, download MediaDownload) error
+	DeleteMediaDownload(ctx context.Context, path string) error
+	// GetMediaAudit returns the latest media audit, finished or not
+	GetMediaAudit(ctx context.Context) (*MediaAudit, error)
+	PutMediaAudit(ctx context.Context, audit MediaAudit) error
+}
+
+var MediaRefStorage MediaRefStore = datastoreStore{}
+
+// mediaBlobName is where content with the sha256 hex hash is stored
+func mediaBlobName(hash string) string {
+	return "media/sha256/" + hash[:2] + "/" + hash
+}
+
+// archiveMedia downloads a media file into storage, queueing it for a retry
+// when that fails rather than failing the tweet
+func archiveMedia(ctx context.Context, m *Media, tweetId int64) {
+	err := fetchAndStoreMediaFile(ctx, m)
+	if err == nil {
+		return
+	}
+	applog.Warningf(ctx, "Error archiving media %v, queued for retry: %v", m.UploadFileName, err)
+	download := MediaDownload{
+		Path: m.UploadFileName,
+		Url: m.MediaUrl,
+		TweetId: tweetId,
+		Attempts: 1,
+		NextAttempt: time.Now().Add(MEDIA_RETRY_BACKOFF).Unix(),
+		LastError: err.Error(),
+		Created: time.Now().Unix(),
+	}
+	if err = MediaRefStorage.PutMediaDownload(ctx, download); err != nil {
+		applog.Errorf(ctx, "Error queueing media download: %v", err)
+	}
+}
+
+// fetchAndStoreMediaFile downloads m, stores its content under its hash
+// unless that's stored already, and points m's path at it
+func fetchAndStoreMediaFile(ctx context.Context, m *Media) error {
+	return downloadMediaFile(ctx, m, false)
+}
+
+// downloadMediaFile is fetchAndStoreMediaFile, rewriting the stored content
+// when overwrite is set, so a blob found corrupt can be repaired
+func downloadMediaFile(ctx context.Context, m *Media, overwrite bool) error {
+	client := httpClient(ctx)
+	resp, err := client.Get(m.MediaUrl)
+	if err != nil {
+		return fmt.Errorf("Error fetching media file from twitter: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error fetching media file from twitter: %v", resp.Status)
+	}
+
+	// spooled to disk, the hash names the blob so it's only known once read
+	tmp, err := ioutil.TempFile("", "tapp-media")
+	if err != nil {
+		return fmt.Errorf("Error creating temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if err != nil {
+		return fmt.Errorf("Error reading media file: %v", err)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" || strings.HasPrefix(contentType, "application/octet-stream") {
+		contentType = mime.TypeByExtension(path.Ext(m.UploadFileName))
+	}
+
+	name := mediaBlobName(sum)
+	if _, err = MediaStorage.Stat(ctx, name); err == ErrBlobNotFound || (err == nil && overwrite) {
+		if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		applog.Infof(ctx, "Storing media file: %v as %v", m.UploadFileName, name)
+		if err = MediaStorage.Put(ctx, name, tmp, contentType); err != nil {
+			return fmt.Errorf("Error storing media file: %v", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("Error checking media file: %v", err)
+	}
+
+	m.Hash = sum
+	m.Size = size
+	m.ContentType = contentType
+	err = MediaRefStorage.PutMediaRef(ctx, MediaRef{
+		Path: m.UploadFileName,
+		Hash: sum,
+		Size: size,
+		ContentType: contentType,
+		Updated: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(contentType, "image/") {
+		if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		// the original is still served without them
+		thumbnails, err := storeThumbnails(ctx, m.UploadFileName, tmp)
+		if err != nil {
+			applog.Warningf(ctx, "Error generating thumbnails of %v: %v", m.UploadFileName, err)
+		}
+		m.SmallFileName = thumbnails[THUMBNAIL_SMALL]
+		m.MediumFileName = thumbnails[THUMBNAIL_MEDIUM]
+	}
+	return nil
+}
+
+// retryMediaDownloads tries the queued downloads that are due again, backing
+// off exponentially and giving up after MEDIA_RETRY_LIMIT attempts
+func retryMediaDownloads(ctx context.Context) error {
+	downloads, err := MediaRefStorage.ListMediaDownloads(ctx)
+	if err != nil {
+		return fmt.Errorf("Error listing media downloads: %v", err)
+	}
+
+	now := time.Now()
+	stored, failed := 0, 0
+	for _, download := range downloads {
+		if download.Attempts >= MEDIA_RETRY_LIMIT || download.NextAttempt > now.Unix() {
+			continue
+		}
+		m := Media{MediaUrl: download.Url, UploadFileName: download.Path}
+		if err = fetchAndStoreMediaFile(ctx, &m); err != nil {
+			failed++
+			download.Attempts++
+			download.NextAttempt = now.Add(MEDIA_RETRY_BACKOFF << uint(download.Attempts - 1)).Unix()
+			download.LastError = err.Error()
+			if download.Attempts >= MEDIA_RETRY_LIMIT {
+				applog.Errorf(ctx, "Giving up on media %v after %v attempts: %v", download.Path, download.Attempts, err)
+			}
+			if err = MediaRefStorage.PutMediaDownload(ctx, download); err != nil {
+				return fmt.Errorf("Error updating media download: %v", err)
+			}
+			continue
+		}
+
+		stored++
+		if download.TweetId != 0 {
+			if err = updateTweetMedia(ctx, download.TweetId, m); err != nil {
+				applog.Warningf(ctx, "Error updating media of tweet %v: %v", download.TweetId, err)
+			}
+		}
+		if err = MediaRefStorage.DeleteMediaDownload(ctx, download.Path); err != nil {
+			return fmt.Errorf("Error deleting media download: %v", err)
+		}
+	}
+	applog.Infof(ctx, "retried media downloads: %v stored, %v failed", stored, failed)
+	return nil
+}
+
+// updateTweetMedia records the hash, size, type and thumbnails of stored
+// media on the tweet it belongs to
+func updateTweetMedia(ctx context.Context, tweetId int64, stored Media) error {
+	tweet, err := TweetStorage.GetTweet(ctx, tweetId)
+	if err != nil {
+		return err
+	}
+	for i, m := range tweet.Media {
+		if m.UploadFileName == stored.UploadFileName {
+			tweet.Media[i].Hash = stored.Hash
+			tweet.Media[i].Size = stored.Size
+			tweet.Media[i].ContentType = stored.ContentType
+			tweet.Media[i].SmallFileName = stored.SmallFileName
+			tweet.Media[i].MediumFileName = stored.MediumFileName
+		}
+	}
+	return TweetStorage.PutTweets(ctx, []MyTweet{*tweet})
 }
@@ -0,0 +1,58 @@
+package tapp
+
+import (
+	"context"
+	"net/http"
+	stdlog "log"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/urlfetch"
+	aelog "google.golang.org/appengine/log"
+)
+
+// applog writes to App Engine logging when running there, and to the standard
+// logger when self-hosted
+var applog logger
+
+type logger struct{}
+
+func (logger) Infof(ctx context.Context, format string, args ...interface{}) {
+	if appengine.IsAppEngine() {
+		aelog.Infof(ctx, format, args...)
+	} else {
+		stdlog.Printf("INFO: " + format, args...)
+	}
+}
+
+func (logger) Warningf(ctx context.Context, format string, args ...interface{}) {
+	if appengine.IsAppEngine() {
+		aelog.Warningf(ctx, format, args...)
+	} else {
+		stdlog.Printf("WARNING: " + format, args...)
+	}
+}
+
+func (logger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	if appengine.IsAppEngine() {
+		aelog.Errorf(ctx, format, args...)
+	} else {
+		stdlog.Printf("ERROR: " + format, args...)
+	}
+}
+
+func newContext(r *http.Request) context.Context {
+	if appengine.IsAppEngine() {
+		return appengine.NewContext(r)
+	}
+	return r.Context()
+}
+
+func transport(ctx context.Context) http.RoundTripper {
+	if appengine.IsAppEngine() {
+		return &urlfetch.Transport{Context: ctx}
+	}
+	return http.DefaultTransport
+}
+
+func httpClient(ctx context.Context) *http.Client {
+	return &http.Client{Transport: transport(ctx)}
+}
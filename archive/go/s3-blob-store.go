@@ -0,0 +1,128 @@
+package tapp
+
+import (
+	"io"
+	"fmt"
+	"context"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3BlobStore keeps blobs in a bucket of any S3 compatible service, AWS or a
+// MinIO server
+type S3BlobStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3BlobStore(cfg *Config) (*S3BlobStore, error) {
+	client, err := minio.New(cfg.S3Endpoint, &minio.Options{
+		Creds: credentials.NewStaticV4(cfg.S3AccessKey, cfg.S3SecretKey, ""),
+		Secure: cfg.S3Insecure == false,
+		Region: cfg.S3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error creating s3 client: %v", err)
+	}
+	return &S3BlobStore{client: client, bucket: cfg.Bucket}, nil
+}
+
+// Put streams the blob, with its size when r can seek, like the spooled
+// media downloads, and otherwise in S3_PART_SIZE parts so minio doesn't
+// buffer hundreds of MiB for an upload of unknown size
+func (s *S3BlobStore) Put(ctx context.Context, name string, r io.Reader, contentType string) error {
+	if validBlobName(name) == false {
+		return ErrInvalidBlobName
+	}
+	size := int64(-1)
+	if seeker, ok := r.(io.Seeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		size = end - start
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, name, r, size, minio.PutObjectOptions{ContentType: contentType, PartSize: S3_PART_SIZE})
+	return err
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, name string) (io.ReadSeekCloser, *BlobInfo, error) {
+	if validBlobName(name) == false {
+		return nil, nil, ErrInvalidBlobName
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, s3Error(err)
+	}
+	// the request is only made once the object is first used
+	stat, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, nil, s3Error(err)
+	}
+	info := s3BlobInfo(stat)
+	return obj, &info, nil
+}
+
+func (s *S3BlobStore) Stat(ctx context.Context, name string) (*BlobInfo, error) {
+	if validBlobName(name) == false {
+		return nil, ErrInvalidBlobName
+	}
+	stat, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	info := s3BlobInfo(stat)
+	return &info, nil
+}
+
+// Delete checks the blob exists first, S3 deletes of missing keys succeed
+func (s *S3BlobStore) Delete(ctx context.Context, name string) error {
+	if _, err := s.Stat(ctx, name); err != nil {
+		return err
+	}
+	return s3Error(s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{}))
+}
+
+func (s *S3BlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	infos := []BlobInfo{}
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("Error listing bucket: %v", obj.Err)
+		}
+		infos = append(infos, s3BlobInfo(obj))
+	}
+	return infos, nil
+}
+
+// Close has nothing to release, the minio client has no persistent state
+func (s *S3BlobStore) Close() error {
+	return nil
+}
+
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if resp := minio.ToErrorResponse(err); resp.Code == "NoSuchKey" || resp.Code == "NotFound" {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func s3BlobInfo(obj minio.ObjectInfo) BlobInfo {
+	return BlobInfo{
+		Name: obj.Key,
+		Size: obj.Size,
+		ContentType: obj.ContentType,
+		Updated: obj.LastModified,
+		ETag: obj.ETag,
+	}
+}
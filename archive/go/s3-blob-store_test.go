@@ -0,0 +1,44 @@
+package tapp
+
+import (
+	"os"
+	"context"
+	"testing"
+	"github.com/minio/minio-go/v7"
+)
+
+// TestS3BlobStore runs against the S3 or MinIO server at
+// TAPP_TEST_S3_ENDPOINT, e.g. localhost:9000 for
+// docker run -p 9000:9000 minio/minio server /data
+func TestS3BlobStore(t *testing.T) {
+	endpoint := os.Getenv("TAPP_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("TAPP_TEST_S3_ENDPOINT is not set")
+	}
+	cfg := DefaultConfig()
+	cfg.S3Endpoint = endpoint
+	cfg.S3AccessKey = os.Getenv("TAPP_TEST_S3_ACCESS_KEY")
+	cfg.S3SecretKey = os.Getenv("TAPP_TEST_S3_SECRET_KEY")
+	cfg.S3Insecure = os.Getenv("TAPP_TEST_S3_SECURE") == ""
+	cfg.Bucket = os.Getenv("TAPP_TEST_S3_BUCKET")
+	if cfg.Bucket == "" {
+		cfg.Bucket = "tapp-test"
+	}
+	store, err := NewS3BlobStore(cfg)
+	if err != nil {
+		t.Fatalf("Error opening s3 store: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	exists, err := store.client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		t.Fatalf("Error checking bucket: %v", err)
+	}
+	if exists == false {
+		if err = store.client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.S3Region}); err != nil {
+			t.Fatalf("Error making bucket: %v", err)
+		}
+	}
+	testBlobStore(t, store)
+}
@@ -0,0 +1,277 @@
+package tapp
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"strconv"
+	"strings"
+	"io/ioutil"
+	"crypto/rand"
+	"encoding/hex"
+	"gopkg.in/yaml.v2"
+)
+
+var ErrJobRunning = errors.New("tapp: job already running")
+
+type JobFunc func(ctx context.Context) error
+
+// JobStatus is the last known state of a periodic job
+type JobStatus struct {
+	Name string
+	Schedule string
+	Running bool
+	LastRun int64
+	DurationMs int64
+	Error string
+}
+
+// JobLease is a job's stored state, shared by every instance: the run
+// holding it while it runs, and how its last run went
+type JobLease struct {
+	Name string
+	// random id of the run holding the lease, empty when it's free
+	Holder string
+	Expires int64
+	LastRun int64
+	DurationMs int64
+	Error string `datastore:",noindex"`
+}
+
+// heldByOther tells whether a run other than holder has the lease at now
+func (lease JobLease) heldByOther(holder string, now int64) bool {
+	return lease.Holder != "" && lease.Holder != holder && lease.Expires > now
+}
+
+// JobStore persists the job leases
+type JobStore interface {
+	// AcquireJobLease takes or extends name's lease for holder until expires,
+	// failing with ErrJobRunning while another run's lease hasn't expired
+	AcquireJobLease(ctx context.Context, name string, holder string, expires int64) error
+	// ReleaseJobLease frees lease.Holder's lease, recording the run's result,
+	// unless it expired and another run took it
+	ReleaseJobLease(ctx context.Context, lease JobLease) error
+	ListJobLeases(ctx context.Context) ([]JobLease, error)
+}
+
+// Schedule is one entry of cron.yaml
+type Schedule struct {
+	Description string `yaml:"description"`
+	Url string `yaml:"url"`
+	Schedule string `yaml:"schedule"`
+}
+
+type scheduledJob struct {
+	run JobFunc
+	schedule string
+}
+
+// Scheduler runs the periodic jobs, either when App Engine cron requests
+// them or on its own timers. A lease in the JobStore keeps the same job from
+// running twice at once, on this instance or any other.
+type Scheduler struct {
+	mu sync.Mutex
+	jobs map[string]*scheduledJob
+}
+
+// Jobs are keyed by the cron url that triggers them
+var Jobs = NewScheduler(map[string]JobFunc{
+	"/fetch": func(ctx context.Context) error {
+		return forEachAccount(ctx, func(ctx context.Context, account string) error {
+			_, err := fetchAndStoreTweets(ctx, account)
+			return err
+		})
+	},
+	"/update/tweets": updateDatastoreTweets,
+	// also run by /update/tweets, this claims old tweets without waiting for it
+	"/migrate/owners": claimUnownedTweets,
+	"/update/user": func(ctx context.Context) error {
+		return forEachAccount(ctx, func(ctx context.Context, account string) error {
+			_, err := fetchAndStoreUser(ctx, account)
+			return err
+		})
+	},
+	"/unretweet": unretweetTweets,
+	"/retry/media": retryMediaDownloads,
+	"/audit/media": continueMediaAudit,
+})
+
+func NewScheduler(jobs map[string]JobFunc) *Scheduler {
+	s := &Scheduler{jobs: map[string]*scheduledJob{}}
+	for name, run := range jobs {
+		s.jobs[name] = &scheduledJob{run: run}
+	}
+	return s
+}
+
+func (s *Scheduler) Run(ctx context.Context, name string) error {
+	s.mu.Lock()
+	job, ok := s.jobs[name]
+	s.mu.Unlock()
+	if ok == false {
+		return fmt.Errorf("Error unknown job: %v", name)
+	}
+	return s.RunAs(ctx, name, job.run)
+}
+
+// RunAs runs run under the lease of the job name, for handlers doing part of
+// a job's work themselves
+func (s *Scheduler) RunAs(ctx context.Context, name string, run JobFunc) error {
+	holder := newJobHolder()
+	if err := JobStorage.AcquireJobLease(ctx, name, holder, time.Now().Add(JOB_LEASE_LENGTH).Unix()); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go renewJobLease(ctx, name, holder, done)
+
+	start := time.Now()
+	err := run(ctx)
+	close(done)
+
+	lease := JobLease{
+		Name: name,
+		Holder: holder,
+		LastRun: start.Unix(),
+		DurationMs: int64(time.Since(start) / time.Millisecond),
+	}
+	if err != nil {
+		lease.Error = err.Error()
+	}
+	if releaseErr := JobStorage.ReleaseJobLease(ctx, lease); releaseErr != nil {
+		applog.Errorf(ctx, "Error releasing job %v: %v", name, releaseErr)
+	}
+	return err
+}
+
+// renewJobLease keeps extending holder's lease until done, so a long run
+// keeps it while one on a dead instance soon gives it up
+func renewJobLease(ctx context.Context, name string, holder string, done chan struct{}) {
+	ticker := time.NewTicker(JOB_LEASE_LENGTH / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := JobStorage.AcquireJobLease(ctx, name, holder, time.Now().Add(JOB_LEASE_LENGTH).Unix()); err != nil {
+				applog.Errorf(ctx, "Error renewing job %v: %v", name, err)
+			}
+		}
+	}
+}
+
+func newJobHolder() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *Scheduler) Status(ctx context.Context) ([]JobStatus, error) {
+	leases, err := JobStorage.ListJobLeases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]JobLease{}
+	for _, lease := range leases {
+		byName[lease.Name] = lease
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+	statuses := []JobStatus{}
+	for name, job := range s.jobs {
+		lease := byName[name]
+		statuses = append(statuses, JobStatus{
+			Name: name,
+			Schedule: job.schedule,
+			Running: lease.heldByOther("", now),
+			LastRun: lease.LastRun,
+			DurationMs: lease.DurationMs,
+			Error: lease.Error,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses, nil
+}
+
+// Start runs each scheduled job on its interval until ctx is done
+func (s *Scheduler) Start(ctx context.Context, schedules []Schedule) error {
+	intervals := map[string]time.Duration{}
+	for _, schedule := range schedules {
+		if _, ok := s.jobs[schedule.Url]; ok == false {
+			return fmt.Errorf("Error no job for cron url: %v", schedule.Url)
+		}
+		interval, err := parseSchedule(schedule.Schedule)
+		if err != nil {
+			return err
+		}
+		intervals[schedule.Url] = interval
+		s.mu.Lock()
+		s.jobs[schedule.Url].schedule = schedule.Schedule
+		s.mu.Unlock()
+	}
+
+	for name, interval := range intervals {
+		go s.loop(ctx, name, interval)
+	}
+	return nil
+}
+
+func (s *Scheduler) loop(ctx context.Context, name string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Run(ctx, name); err != nil {
+				applog.Errorf(ctx, "Error running job %v: %v", name, err)
+			}
+		}
+	}
+}
+
+// LoadSchedules reads job schedules from a cron.yaml file
+func LoadSchedules(fileName string) ([]Schedule, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	cron := struct {
+		Cron []Schedule `yaml:"cron"`
+	}{}
+	if err = yaml.Unmarshal(contents, &cron); err != nil {
+		return nil, fmt.Errorf("Error parsing %v: %v", fileName, err)
+	}
+	return cron.Cron, nil
+}
+
+// parseSchedule understands the "every N minutes|hours" cron.yaml form
+func parseSchedule(schedule string) (time.Duration, error) {
+	fields := strings.Fields(schedule)
+	if len(fields) != 3 || fields[0] != "every" {
+		return 0, fmt.Errorf("Error unsupported schedule: %q", schedule)
+	}
+
+	num, err := strconv.Atoi(fields[1])
+	if err != nil || num <= 0 {
+		return 0, fmt.Errorf("Error unsupported schedule: %q", schedule)
+	}
+
+	switch fields[2] {
+	case "minutes", "minute", "mins", "min":
+		return time.Duration(num) * time.Minute, nil
+	case "hours", "hour":
+		return time.Duration(num) * time.Hour, nil
+	}
+	return 0, fmt.Errorf("Error unsupported schedule: %q", schedule)
+}
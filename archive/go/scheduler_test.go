@@ -0,0 +1,93 @@
+package tapp
+
+import (
+	"time"
+	"errors"
+	"context"
+	"testing"
+)
+
+func TestSchedulerLease(t *testing.T) {
+	newTestRouter(t)
+	ctx := context.Background()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	jobs := map[string]JobFunc{
+		"/slow": func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		},
+		"/fail": func(ctx context.Context) error {
+			return errors.New("boom")
+		},
+	}
+	// two schedulers over one store, as on two instances
+	first, second := NewScheduler(jobs), NewScheduler(jobs)
+
+	done := make(chan error)
+	go func() {
+		done <- first.Run(ctx, "/slow")
+	}()
+	<-started
+	if err := second.Run(ctx, "/slow"); err != ErrJobRunning {
+		t.Errorf("second run of a running job = %v, want ErrJobRunning", err)
+	}
+	statuses, err := second.Status(ctx)
+	if err != nil {
+		t.Fatalf("Error getting statuses: %v", err)
+	}
+	if statuses[1].Name != "/slow" || statuses[1].Running == false {
+		t.Errorf("status while running = %+v", statuses[1])
+	}
+
+	close(release)
+	if err = <-done; err != nil {
+		t.Fatalf("Error running /slow: %v", err)
+	}
+	if err = second.Run(ctx, "/fail"); err == nil {
+		t.Errorf("running /fail = nil, want its error")
+	}
+
+	statuses, err = first.Status(ctx)
+	if err != nil {
+		t.Fatalf("Error getting statuses: %v", err)
+	}
+	if statuses[1].Running || statuses[1].LastRun == 0 {
+		t.Errorf("status after running = %+v", statuses[1])
+	}
+	if statuses[0].Name != "/fail" || statuses[0].Error != "boom" {
+		t.Errorf("status of a failed run = %+v", statuses[0])
+	}
+}
+
+func TestSchedulerExpiredLease(t *testing.T) {
+	newTestRouter(t)
+	ctx := context.Background()
+
+	// a run on an instance that died keeps its lease only until it expires
+	if err := JobStorage.AcquireJobLease(ctx, "/job", "dead", time.Now().Add(-time.Minute).Unix()); err != nil {
+		t.Fatalf("Error taking lease: %v", err)
+	}
+	ran := false
+	s := NewScheduler(map[string]JobFunc{
+		"/job": func(ctx context.Context) error {
+			ran = true
+			return nil
+		},
+	})
+	if err := s.Run(ctx, "/job"); err != nil || ran == false {
+		t.Errorf("run over an expired lease = %v, ran %v", err, ran)
+	}
+
+	// a release by a run that lost its lease leaves the new holder's alone
+	if err := JobStorage.AcquireJobLease(ctx, "/job", "live", time.Now().Add(time.Minute).Unix()); err != nil {
+		t.Fatalf("Error taking lease: %v", err)
+	}
+	if err := JobStorage.ReleaseJobLease(ctx, JobLease{Name: "/job", Holder: "dead"}); err != nil {
+		t.Fatalf("Error releasing lease: %v", err)
+	}
+	if err := s.Run(ctx, "/job"); err != ErrJobRunning {
+		t.Errorf("run while live holds the lease = %v, want ErrJobRunning", err)
+	}
+}
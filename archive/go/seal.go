@@ -0,0 +1,140 @@
+package tapp
+
+import (
+	"io"
+	"fmt"
+	"bytes"
+	"errors"
+	"strings"
+	"crypto/aes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+var ErrNoEncryptionKey = errors.New("tapp: no encryption key configured")
+
+// Keyring seals with its current key and opens with any of its keys, so keys
+// can be rotated without losing what the old ones sealed. Sealed values start
+// with the id of their key.
+type Keyring struct {
+	current []byte
+	keys map[string][]byte
+}
+
+// NewKeyring derives AES-256 keys from the current and old master keys, each
+// at least 32 random bytes in base64, e.g. from openssl rand -base64 32
+func NewKeyring(current string, old ...string) (*Keyring, error) {
+	if current == "" {
+		return nil, ErrNoEncryptionKey
+	}
+	k := &Keyring{keys: map[string][]byte{}}
+	for i, master := range append([]string{current}, old...) {
+		if master == "" {
+			continue
+		}
+		key, err := deriveKey(master)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			k.current = key
+		}
+		k.keys[string(keyId(key))] = key
+	}
+	return k, nil
+}
+
+// deriveKey expands a master key into the AES key with HKDF
+func deriveKey(master string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(master))
+	if err != nil || len(raw) < MASTER_KEY_LENGTH {
+		return nil, fmt.Errorf("Error reading encryption key: want at least %v random bytes in base64", MASTER_KEY_LENGTH)
+	}
+	return hkdf.Key(sha256.New, raw, nil, SEAL_KEY_INFO, 32)
+}
+
+func keyId(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:KEY_ID_LENGTH]
+}
+
+func keyCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts plain with AES-GCM under the current key, as key id, nonce
+// and ciphertext. The name of the secret is authenticated with it, so a value
+// can't be opened as another secret.
+func (k *Keyring) Seal(name string, plain string) ([]byte, error) {
+	gcm, err := keyCipher(k.current)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append(keyId(k.current), nonce...)
+	return gcm.Seal(out, nonce, []byte(plain), []byte(name)), nil
+}
+
+func (k *Keyring) Open(name string, sealed []byte) (string, error) {
+	if len(sealed) <= KEY_ID_LENGTH {
+		return "", fmt.Errorf("Error opening secret %v: too short", name)
+	}
+	key, ok := k.keys[string(sealed[:KEY_ID_LENGTH])]
+	if ok == false {
+		return "", fmt.Errorf("Error opening secret %v: no key in the keyring sealed it", name)
+	}
+	return openWith(key, name, sealed[KEY_ID_LENGTH:])
+}
+
+// Stale tells whether sealed was not sealed with the current key
+func (k *Keyring) Stale(sealed []byte) bool {
+	return len(sealed) <= KEY_ID_LENGTH || bytes.Equal(sealed[:KEY_ID_LENGTH], keyId(k.current)) == false
+}
+
+func openWith(key []byte, name string, sealed []byte) (string, error) {
+	gcm, err := keyCipher(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("Error opening secret %v: too short", name)
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("Error opening secret %v: %v", name, err)
+	}
+	return string(plain), nil
+}
+
+// sealKeyring seals secrets kept in the datastore. Its key is the
+// encryptionKey setting, and oldEncryptionKeys still open what earlier keys
+// sealed.
+func sealKeyring() (*Keyring, error) {
+	return NewKeyring(AppConfig.EncryptionKey, AppConfig.OldEncryptionKeys...)
+}
+
+func sealSecret(name string, plain string) ([]byte, error) {
+	keys, err := sealKeyring()
+	if err != nil {
+		return nil, err
+	}
+	return keys.Seal(name, plain)
+}
+
+func openSecret(name string, sealed []byte) (string, error) {
+	keys, err := sealKeyring()
+	if err != nil {
+		return "", err
+	}
+	return keys.Open(name, sealed)
+}
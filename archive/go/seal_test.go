@@ -0,0 +1,56 @@
+package tapp
+
+import (
+	"testing"
+	"crypto/rand"
+	"encoding/base64"
+)
+
+func testMasterKey(t *testing.T) string {
+	t.Helper()
+	raw := make([]byte, MASTER_KEY_LENGTH)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatalf("Error reading random key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestKeyring(t *testing.T) {
+	oldKey, newKey := testMasterKey(t), testMasterKey(t)
+	keys, err := NewKeyring(oldKey)
+	if err != nil {
+		t.Fatalf("Error making keyring: %v", err)
+	}
+	sealed, err := keys.Seal("consumerKeySecret", "hunter2")
+	if err != nil {
+		t.Fatalf("Error sealing: %v", err)
+	}
+	if plain, err := keys.Open("consumerKeySecret", sealed); err != nil || plain != "hunter2" {
+		t.Errorf("open = %q, %v", plain, err)
+	}
+	// the name is authenticated, a value can't stand in for another secret
+	if _, err = keys.Open("accessTokenSecret", sealed); err == nil {
+		t.Errorf("opening under another name = nil error")
+	}
+
+	rotated, err := NewKeyring(newKey, oldKey)
+	if err != nil {
+		t.Fatalf("Error making keyring: %v", err)
+	}
+	if plain, err := rotated.Open("consumerKeySecret", sealed); err != nil || plain != "hunter2" || rotated.Stale(sealed) == false {
+		t.Errorf("open with the old key = %q, %v, stale %v", plain, err, rotated.Stale(sealed))
+	}
+	resealed, _ := rotated.Seal("consumerKeySecret", "hunter2")
+	if rotated.Stale(resealed) {
+		t.Errorf("value sealed with the current key is stale")
+	}
+	if _, err = keys.Open("consumerKeySecret", resealed); err == nil {
+		t.Errorf("opening without the new key = nil error")
+	}
+
+	for _, weak := range []string{"passphrase", base64.StdEncoding.EncodeToString([]byte("sixteen byte key"))} {
+		if _, err = NewKeyring(weak); err == nil {
+			t.Errorf("keyring from %q = nil error", weak)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package tapp
+
+import (
+	"sort"
+	"errors"
+	"context"
+	"unicode/utf8"
+)
+
+var ErrSearchTooBroad = errors.New("a prefix* in the search matches too many words, make it longer")
+
+// expandSearchTerms looks up the indexed tokens matched by prefix* and fuzzy~
+// terms, storing their merged postings under the term's pattern key
+func expandSearchTerms(ctx context.Context, node SearchNode, postings map[string][]Posting) error {
+	vocabularies := map[string][]string{}
+	for _, term := range positiveSearchTerms(node) {
+		if term.expanded() == false {
+			continue
+		}
+		key := term.patternKey()
+		if _, done := postings[key]; done {
+			continue
+		}
+
+		last := term.Tokens[len(term.Tokens) - 1]
+		var tokens []string
+		if term.Prefix {
+			var err error
+			if tokens, err = IndexStorage.ListTokens(ctx, last, AppConfig.MaxTermExpansion + 1); err != nil {
+				return err
+			}
+			if len(tokens) > AppConfig.MaxTermExpansion {
+				return ErrSearchTooBroad
+			}
+		} else {
+			vocabulary, err := fuzzyCandidates(ctx, last, vocabularies)
+			if err != nil {
+				return err
+			}
+			for _, token := range vocabulary {
+				if fuzzyMatches(token, last, term.Fuzzy) {
+					tokens = append(tokens, token)
+				}
+			}
+		}
+
+		stored, err := IndexStorage.GetTerms(ctx, tokens)
+		if err != nil {
+			return err
+		}
+		postings[key] = mergePostings(stored)
+	}
+	return nil
+}
+
+// fuzzyCandidates lists the indexed tokens that may be a few edits from
+// token, those sharing its first rune as typos rarely start a word. Each
+// rune's list is cached until indexTweets adds or drops a token starting
+// with it, and kept in vocabularies for the rest of the search.
+func fuzzyCandidates(ctx context.Context, token string, vocabularies map[string][]string) ([]string, error) {
+	first, _ := utf8.DecodeRuneInString(token)
+	prefix := string(first)
+	if tokens, ok := vocabularies[prefix]; ok {
+		return tokens, nil
+	}
+
+	var tokens []string
+	key := MEMCACHE_VOCABULARY_KEY + prefix
+	if err := cache.Get(ctx, key, &tokens); err != nil || tokens == nil {
+		if tokens, err = IndexStorage.ListTokens(ctx, prefix, 0); err != nil {
+			return nil, err
+		}
+		cache.Set(ctx, key, tokens)
+	}
+	vocabularies[prefix] = tokens
+	return tokens, nil
+}
+
+// invalidateVocabulary drops the cached candidate lists holding tokens
+func invalidateVocabulary(ctx context.Context, tokens []string) {
+	dropped := map[string]bool{}
+	for _, token := range tokens {
+		first, _ := utf8.DecodeRuneInString(token)
+		prefix := string(first)
+		if dropped[prefix] {
+			continue
+		}
+		dropped[prefix] = true
+		if err := cache.Delete(ctx, MEMCACHE_VOCABULARY_KEY + prefix); err != nil {
+			applog.Warningf(ctx, "Error invalidating cached vocabulary %q: %v", prefix, err)
+		}
+	}
+}
+
+// fuzzyMatches tells whether token is within distance edits of target and
+// starts with the same rune, the rule fuzzyCandidates looks tokens up by
+func fuzzyMatches(token string, target string, distance int) bool {
+	first, _ := utf8.DecodeRuneInString(token)
+	want, _ := utf8.DecodeRuneInString(target)
+	return first == want && editDistance(token, target, distance) <= distance
+}
+
+// mergePostings combines the postings of several tokens as if they were one
+func mergePostings(terms []IndexTerm) []Posting {
+	positions := map[int64][]int{}
+	for _, term := range terms {
+		for _, posting := range term.Postings {
+			positions[posting.TweetId] = append(positions[posting.TweetId], posting.Positions...)
+		}
+	}
+	merged := []Posting{}
+	for id, pos := range positions {
+		sort.Ints(pos)
+		merged = append(merged, Posting{TweetId: id, Positions: pos})
+	}
+	return sortPostings(merged)
+}
+
+// editDistance is the Levenshtein distance between a and b in runes, giving
+// up with limit + 1 once it is known to be over limit
+func editDistance(a string, b string, limit int) int {
+	ra, rb := []rune(a), []rune(b)
+	if diff := len(ra) - len(rb); diff > limit || -diff > limit {
+		return limit + 1
+	}
+
+	prev := make([]int, len(rb) + 1)
+	cur := make([]int, len(rb) + 1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		best := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i - 1] == rb[j - 1] {
+				cost = 0
+			}
+			cur[j] = min(min(prev[j] + 1, cur[j - 1] + 1), prev[j - 1] + cost)
+			best = min(best, cur[j])
+		}
+		if best > limit {
+			return limit + 1
+		}
+		prev, cur = cur, prev
+	}
+	return min(prev[len(rb)], limit + 1)
+}
+
+// suggestSearch builds a "did you mean" query, replacing plain words of search
+// that are not in the index with the closest indexed token. An empty string
+// is returned when there is nothing to correct.
+func suggestSearch(ctx context.Context, search string, node SearchNode, match *indexMatch) (string, error) {
+	missing := []TermNode{}
+	for _, n := range positiveTermNodes(node) {
+		if n.Term.Quoted || n.Term.expanded() || len(n.Term.Tokens) != 1 {
+			continue
+		}
+		if len(match.Postings[n.Term.Tokens[0]]) == 0 {
+			missing = append(missing, n)
+		}
+	}
+	if len(missing) == 0 {
+		return "", nil
+	}
+
+	vocabularies := map[string][]string{}
+	runes := []rune(search)
+	changed := false
+	// replace from the end so earlier offsets stay valid
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].Pos > missing[j].Pos
+	})
+	for _, n := range missing {
+		token := n.Term.Tokens[0]
+		maxDist := 1
+		if len([]rune(token)) > 4 {
+			maxDist = AppConfig.MaxFuzzyDistance
+		}
+
+		vocabulary, err := fuzzyCandidates(ctx, token, vocabularies)
+		if err != nil {
+			return "", err
+		}
+		best := maxDist + 1
+		candidates := []string{}
+		for _, word := range vocabulary {
+			dist := editDistance(word, token, maxDist)
+			if dist > best {
+				continue
+			}
+			if dist < best {
+				best = dist
+				candidates = candidates[:0]
+			}
+			candidates = append(candidates, word)
+		}
+		if best > maxDist {
+			continue
+		}
+
+		// closest words tie break on how many tweets they appear in
+		terms, err := IndexStorage.GetTerms(ctx, candidates)
+		if err != nil {
+			return "", err
+		}
+		suggestion := ""
+		freq := -1
+		for _, term := range terms {
+			if len(term.Postings) > freq {
+				suggestion = term.Token
+				freq = len(term.Postings)
+			}
+		}
+		if suggestion == "" {
+			continue
+		}
+
+		runes = append(runes[:n.Pos], append([]rune(suggestion), runes[n.End:]...)...)
+		changed = true
+	}
+
+	if changed == false {
+		return "", nil
+	}
+	return string(runes), nil
+}
+
+// positiveTermNodes lists the term nodes of node that are not excluded
+func positiveTermNodes(node SearchNode) []TermNode {
+	nodes := []TermNode{}
+	switch n := node.(type) {
+	case TermNode:
+		nodes = append(nodes, n)
+	case AndNode:
+		for _, child := range n.Nodes {
+			nodes = append(nodes, positiveTermNodes(child)...)
+		}
+	case OrNode:
+		for _, child := range n.Nodes {
+			nodes = append(nodes, positiveTermNodes(child)...)
+		}
+	}
+	return nodes
+}
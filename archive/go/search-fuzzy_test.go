@@ -0,0 +1,54 @@
+package tapp
+
+import (
+	"context"
+	"testing"
+	"net/url"
+	"net/http"
+)
+
+func TestFuzzyCandidates(t *testing.T) {
+	mux := newTestRouter(t)
+	ctx := context.Background()
+	if err := storeTweets(ctx, []MyTweet{{Id: 1, IdStr: "1", Owner: "alice", Text: "kitten"}}); err != nil {
+		t.Fatalf("Error storing tweets: %v", err)
+	}
+
+	search := func(q string) []int64 {
+		var found []MyTweet
+		decodeBody(t, serve(mux, "GET", "/tweets/search?page=0&search=" + url.QueryEscape(q)), &found)
+		return tweetIds(found)
+	}
+	if ids := search("kiten~1"); sameIds(ids, 1) == false {
+		t.Errorf("search kiten~1 = %v, want [1]", ids)
+	}
+	var cached []string
+	if err := cache.Get(ctx, MEMCACHE_VOCABULARY_KEY + "k", &cached); err != nil || len(cached) != 1 {
+		t.Errorf("cached candidates for k = %v, %v", cached, err)
+	}
+
+	// a new token drops the cached list for its first rune
+	if err := storeTweets(ctx, []MyTweet{{Id: 2, IdStr: "2", Owner: "alice", Text: "kitchen"}}); err != nil {
+		t.Fatalf("Error storing tweets: %v", err)
+	}
+	if ids := search("kitchn~1"); sameIds(ids, 2) == false {
+		t.Errorf("search kitchn~1 = %v, want [2]", ids)
+	}
+
+	// candidates share the first rune
+	if ids := search("bitten~1"); len(ids) != 0 {
+		t.Errorf("search bitten~1 = %v, want none", ids)
+	}
+	// and the same rule holds when every tweet is checked
+	if ids := search("bitten~1 OR -kitten"); sameIds(ids, 2) == false {
+		t.Errorf("search bitten~1 OR -kitten = %v, want [2]", ids)
+	}
+
+	AppConfig.MaxTermExpansion = 1
+	if w := serve(mux, "GET", "/tweets/search?page=0&search=kit*"); w.Code != http.StatusBadRequest {
+		t.Errorf("search kit* over maxTermExpansion: %v %v", w.Code, w.Body.String())
+	}
+	if ids := search("kitc*"); sameIds(ids, 2) == false {
+		t.Errorf("search kitc* = %v, want [2]", ids)
+	}
+}
@@ -0,0 +1,101 @@
+package tapp
+
+import (
+	"sort"
+	"html"
+	"strings"
+	"unicode/utf8"
+)
+
+// Span is a byte range of a tweet's Text
+type Span struct {
+	Start int
+	End int
+}
+
+// SearchHit is a tweet matching a search, with the ranges of Text that
+// matched and an html snippet around them with matches wrapped in <mark>.
+// Score is only set when ordering by relevance.
+type SearchHit struct {
+	MyTweet
+	Matches []Span
+	Snippet string
+	Score float64
+}
+
+func newSearchHit(tweet MyTweet, node SearchNode) SearchHit {
+	spans := searchNodeSpans(node, tokenizeSpans(tweet.Text))
+	return SearchHit{
+		MyTweet: tweet,
+		Matches: spans,
+		Snippet: highlightSnippet(tweet.Text, spans),
+	}
+}
+
+// searchNodeSpans finds the text matched by every term of node that is not
+// excluded, merging overlapping ranges
+func searchNodeSpans(node SearchNode, textTokens []TextToken) []Span {
+	tokens := make([]string, len(textTokens))
+	for i, t := range textTokens {
+		tokens[i] = t.Token
+	}
+
+	spans := []Span{}
+	for _, term := range positiveSearchTerms(node) {
+		for _, i := range term.FindTokens(tokens) {
+			last := textTokens[i + len(term.Tokens) - 1]
+			spans = append(spans, Span{Start: textTokens[i].Start, End: last.End})
+		}
+	}
+
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].Start < spans[j].Start
+	})
+	merged := []Span{}
+	for _, span := range spans {
+		if n := len(merged); n > 0 && span.Start <= merged[n - 1].End {
+			merged[n - 1].End = max(merged[n - 1].End, span.End)
+		} else {
+			merged = append(merged, span)
+		}
+	}
+	return merged
+}
+
+// highlightSnippet cuts text down to the first match plus AppConfig.SnippetContext
+// bytes either side, html escaped, with matches wrapped in <mark>
+func highlightSnippet(text string, spans []Span) string {
+	start, end := 0, len(text)
+	if len(spans) > 0 {
+		start = max(0, spans[0].Start - AppConfig.SnippetContext)
+		end = min(len(text), spans[0].End + AppConfig.SnippetContext)
+	} else {
+		end = min(len(text), AppConfig.SnippetContext * 2)
+	}
+	for start > 0 && utf8.RuneStart(text[start]) == false {
+		start--
+	}
+	for end < len(text) && utf8.RuneStart(text[end]) == false {
+		end++
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, span := range spans {
+		if span.End <= start || span.Start >= end {
+			continue
+		}
+		s, e := max(span.Start, start), min(span.End, end)
+		b.WriteString(html.EscapeString(text[pos:s]))
+		b.WriteString("<mark>" + html.EscapeString(text[s:e]) + "</mark>")
+		pos = e
+	}
+	b.WriteString(html.EscapeString(text[pos:end]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
@@ -0,0 +1,367 @@
+package tapp
+
+import (
+	"sort"
+	"errors"
+	"context"
+	"encoding/binary"
+)
+
+// IndexStore persists the inverted search index, token -> postings
+type IndexStore interface {
+	// GetTerms returns the stored terms for tokens, skipping unknown tokens
+	GetTerms(ctx context.Context, tokens []string) ([]IndexTerm, error)
+	// ListTokens returns the indexed tokens starting with prefix in order, at
+	// most limit of them unless limit is 0
+	ListTokens(ctx context.Context, prefix string, limit int) ([]string, error)
+	// UpdateTerms applies each update to its stored term atomically, so
+	// concurrent jobs don't drop each other's postings, deleting terms left
+	// without postings. It returns the tokens added to or gone from the index
+	UpdateTerms(ctx context.Context, updates []TermUpdate) ([]string, error)
+	// ClearTerms empties the index, including its stats
+	ClearTerms(ctx context.Context) error
+	GetStats(ctx context.Context) (IndexStats, error)
+	// AddStats adds delta to the stored stats atomically, so concurrent jobs
+	// indexing tweets don't lose each other's counts
+	AddStats(ctx context.Context, delta IndexStats) error
+}
+
+var IndexStorage IndexStore = datastoreStore{}
+
+type IndexTerm struct {
+	Token string
+	Postings []Posting
+}
+
+// IndexStats are the corpus totals needed for relevance ranking
+type IndexStats struct {
+	Docs int64
+	Tokens int64
+}
+
+// Posting records where a token appears in one tweet, positions are token
+// offsets used to match quoted phrases
+type Posting struct {
+	TweetId int64
+	Positions []int
+}
+
+// TermUpdate changes the postings of one token, Removed are tweets no longer
+// holding it and Added replace any postings of their tweets
+type TermUpdate struct {
+	Token string
+	Removed []int64
+	Added []Posting
+}
+
+// apply returns postings with the update made to them
+func (update TermUpdate) apply(postings []Posting) []Posting {
+	drop := map[int64]bool{}
+	for _, id := range update.Removed {
+		drop[id] = true
+	}
+	for _, posting := range update.Added {
+		drop[posting.TweetId] = true
+	}
+	kept := []Posting{}
+	for _, posting := range postings {
+		if drop[posting.TweetId] == false {
+			kept = append(kept, posting)
+		}
+	}
+	return sortPostings(append(kept, update.Added...))
+}
+
+// postingShard groups tweet ids into ranges, snowflake ids hold a millisecond
+// timestamp above bit 22 so each shard spans about 25 days of tweets
+func postingShard(id int64) int64 {
+	return id >> INDEX_SHARD_BITS
+}
+
+// indexTweets brings the index in line with tweets that changed from old to
+// updated, deleted tweets are dropped from the index
+func indexTweets(ctx context.Context, old []MyTweet, updated []MyTweet) error {
+	previous := map[int64]MyTweet{}
+	for _, tweet := range old {
+		previous[tweet.Id] = tweet
+	}
+
+	removed := map[string][]int64{}
+	added := map[string][]Posting{}
+	delta := IndexStats{}
+	for _, tweet := range updated {
+		prev, exists := previous[tweet.Id]
+		if exists && prev.Text == tweet.Text && prev.Deleted == tweet.Deleted {
+			continue
+		}
+		if exists && prev.Deleted == false {
+			for token := range tweetPostings(prev) {
+				removed[token] = append(removed[token], prev.Id)
+			}
+			delta.Docs--
+			delta.Tokens -= int64(len(tokenize(prev.Text)))
+		}
+		if tweet.Deleted == false {
+			for token, posting := range tweetPostings(tweet) {
+				added[token] = append(added[token], posting)
+			}
+			delta.Docs++
+			delta.Tokens += int64(len(tokenize(tweet.Text)))
+		}
+	}
+
+	if delta.Docs != 0 || delta.Tokens != 0 {
+		if err := IndexStorage.AddStats(ctx, delta); err != nil {
+			return err
+		}
+	}
+
+	tokens := map[string]bool{}
+	for token := range removed {
+		tokens[token] = true
+	}
+	for token := range added {
+		tokens[token] = true
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+	updates := []TermUpdate{}
+	for token := range tokens {
+		updates = append(updates, TermUpdate{Token: token, Removed: removed[token], Added: added[token]})
+	}
+
+	applog.Infof(ctx, "Updating search index terms: %v", len(updates))
+	// tokens new to the index or gone from it
+	vocabulary, err := IndexStorage.UpdateTerms(ctx, updates)
+	if err != nil {
+		return err
+	}
+	invalidateVocabulary(ctx, vocabulary)
+	return nil
+}
+
+// rebuildSearchIndex indexes every stored tweet from scratch
+func rebuildSearchIndex(ctx context.Context) error {
+	tweets, err := TweetStorage.QueryTweets(ctx, TweetQuery{})
+	if err != nil {
+		return err
+	}
+	if err = IndexStorage.ClearTerms(ctx); err != nil {
+		return err
+	}
+	return indexTweets(ctx, nil, tweets)
+}
+
+func tweetPostings(tweet MyTweet) map[string]Posting {
+	postings := map[string]Posting{}
+	for i, token := range tokenize(tweet.Text) {
+		posting := postings[token]
+		posting.TweetId = tweet.Id
+		posting.Positions = append(posting.Positions, i)
+		postings[token] = posting
+	}
+	return postings
+}
+
+func sortPostings(postings []Posting) []Posting {
+	sort.Slice(postings, func(i, j int) bool {
+		return postings[i].TweetId < postings[j].TweetId
+	})
+	return postings
+}
+
+type indexMatch struct {
+	Ids []int64
+	// false when the index cannot narrow the query, e.g. exclusions or field
+	// filters on their own, and every tweet has to be checked
+	Narrowed bool
+	// postings of every token in the query
+	Postings map[string][]Posting
+}
+
+// searchIndex looks up the ids of tweets that may match node
+func searchIndex(ctx context.Context, node SearchNode) (*indexMatch, error) {
+	stored, err := IndexStorage.GetTerms(ctx, searchNodeTokens(node))
+	if err != nil {
+		return nil, err
+	}
+	match := &indexMatch{Postings: map[string][]Posting{}}
+	for _, term := range stored {
+		match.Postings[term.Token] = term.Postings
+	}
+	if err = expandSearchTerms(ctx, node, match.Postings); err != nil {
+		return nil, err
+	}
+
+	ids, narrowed := nodeCandidates(match.Postings, node)
+	if narrowed == false {
+		return match, nil
+	}
+
+	match.Narrowed = true
+	match.Ids = []int64{}
+	for id := range ids {
+		match.Ids = append(match.Ids, id)
+	}
+	sort.Slice(match.Ids, func(i, j int) bool {
+		return match.Ids[i] < match.Ids[j]
+	})
+	return match, nil
+}
+
+func searchNodeTokens(node SearchNode) []string {
+	tokens := []string{}
+	switch n := node.(type) {
+	case TermNode:
+		tokens = append(tokens, n.Term.IndexTokens()...)
+	case NotNode:
+		tokens = append(tokens, searchNodeTokens(n.Node)...)
+	case AndNode:
+		for _, child := range n.Nodes {
+			tokens = append(tokens, searchNodeTokens(child)...)
+		}
+	case OrNode:
+		for _, child := range n.Nodes {
+			tokens = append(tokens, searchNodeTokens(child)...)
+		}
+	}
+	return tokens
+}
+
+// nodeCandidates returns a superset of the tweet ids matching node, or false
+// if the node does not limit the candidates
+func nodeCandidates(index map[string][]Posting, node SearchNode) (map[int64]bool, bool) {
+	switch n := node.(type) {
+	case TermNode:
+		return phraseTweetIds(index, n.Term.IndexTokens()), true
+	case AndNode:
+		var ids map[int64]bool
+		for _, child := range n.Nodes {
+			childIds, narrowed := nodeCandidates(index, child)
+			if narrowed == false {
+				continue
+			}
+			if ids == nil {
+				ids = childIds
+				continue
+			}
+			for id := range ids {
+				if childIds[id] == false {
+					delete(ids, id)
+				}
+			}
+		}
+		return ids, ids != nil
+	case OrNode:
+		ids := map[int64]bool{}
+		for _, child := range n.Nodes {
+			childIds, narrowed := nodeCandidates(index, child)
+			if narrowed == false {
+				return nil, false
+			}
+			for id := range childIds {
+				ids[id] = true
+			}
+		}
+		return ids, true
+	}
+	return nil, false
+}
+
+// phraseTweetIds finds tweets containing tokens next to each other in order
+func phraseTweetIds(index map[string][]Posting, tokens []string) map[int64]bool {
+	ids := map[int64]bool{}
+	if len(tokens) == 0 {
+		return ids
+	}
+
+	// tweet id -> positions where the phrase so far ends
+	ends := map[int64][]int{}
+	for _, posting := range index[tokens[0]] {
+		ends[posting.TweetId] = posting.Positions
+	}
+	for _, token := range tokens[1:] {
+		next := map[int64][]int{}
+		for _, posting := range index[token] {
+			prev, ok := ends[posting.TweetId]
+			if ok == false {
+				continue
+			}
+			for _, pos := range posting.Positions {
+				if containsInt(prev, pos - 1) {
+					next[posting.TweetId] = append(next[posting.TweetId], pos)
+				}
+			}
+		}
+		ends = next
+	}
+
+	for id := range ends {
+		ids[id] = true
+	}
+	return ids
+}
+
+func containsInt(nums []int, num int) bool {
+	for _, n := range nums {
+		if n == num {
+			return true
+		}
+	}
+	return false
+}
+
+// encodePostings packs postings as delta encoded varints
+func encodePostings(postings []Posting) []byte {
+	buf := make([]byte, 0, len(postings) * 4)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	last := int64(0)
+	for _, posting := range postings {
+		n := binary.PutVarint(tmp, posting.TweetId - last)
+		buf = append(buf, tmp[:n]...)
+		last = posting.TweetId
+		n = binary.PutUvarint(tmp, uint64(len(posting.Positions)))
+		buf = append(buf, tmp[:n]...)
+		for _, pos := range posting.Positions {
+			n = binary.PutUvarint(tmp, uint64(pos))
+			buf = append(buf, tmp[:n]...)
+		}
+	}
+	return buf
+}
+
+var errBadPostings = errors.New("tapp: corrupt index postings")
+
+func decodePostings(buf []byte) ([]Posting, error) {
+	postings := []Posting{}
+	last := int64(0)
+	for len(buf) > 0 {
+		delta, n := binary.Varint(buf)
+		if n <= 0 {
+			return nil, errBadPostings
+		}
+		buf = buf[n:]
+		count, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errBadPostings
+		}
+		buf = buf[n:]
+		if count > uint64(len(buf)) {
+			return nil, errBadPostings
+		}
+
+		posting := Posting{TweetId: last + delta, Positions: make([]int, 0, count)}
+		for i := uint64(0); i < count; i++ {
+			pos, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, errBadPostings
+			}
+			buf = buf[n:]
+			posting.Positions = append(posting.Positions, int(pos))
+		}
+		last = posting.TweetId
+		postings = append(postings, posting)
+	}
+	return postings, nil
+}
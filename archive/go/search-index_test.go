@@ -0,0 +1,57 @@
+package tapp
+
+import (
+	"sync"
+	"context"
+	"testing"
+)
+
+func TestIndexStatsConcurrent(t *testing.T) {
+	newTestRouter(t)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			errs <- indexTweets(ctx, nil, []MyTweet{{Id: id, Text: "three word tweet"}})
+		}(int64(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Error indexing: %v", err)
+		}
+	}
+
+	stats, err := IndexStorage.GetStats(ctx)
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	}
+	if stats.Docs != 20 || stats.Tokens != 60 {
+		t.Errorf("stats after 20 concurrent tweets = %+v", stats)
+	}
+	terms, err := IndexStorage.GetTerms(ctx, []string{"three", "word", "tweet"})
+	if err != nil {
+		t.Fatalf("Error getting terms: %v", err)
+	}
+	for _, term := range terms {
+		if len(term.Postings) != 20 {
+			t.Errorf("postings of %q after 20 concurrent tweets = %v", term.Token, len(term.Postings))
+		}
+	}
+
+	// deleting one takes its counts back out
+	tweet := MyTweet{Id: 1, Text: "three word tweet"}
+	deleted := tweet
+	deleted.Deleted = true
+	if err = indexTweets(ctx, []MyTweet{tweet}, []MyTweet{deleted}); err != nil {
+		t.Fatalf("Error indexing: %v", err)
+	}
+	if stats, _ = IndexStorage.GetStats(ctx); stats.Docs != 19 || stats.Tokens != 57 {
+		t.Errorf("stats after a delete = %+v", stats)
+	}
+}
@@ -0,0 +1,393 @@
+package tapp
+
+import (
+	"fmt"
+	"time"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// SearchNode is a node of a parsed search query
+type SearchNode interface {
+	// Matches evaluates the node against a tweet and its tokenized text
+	Matches(tweet MyTweet, tokens []string) bool
+}
+
+type AndNode struct {
+	Nodes []SearchNode
+}
+
+type OrNode struct {
+	Nodes []SearchNode
+}
+
+type NotNode struct {
+	Node SearchNode
+}
+
+// TermNode matches a word or "quoted phrase"; #hashtags and @mentions keep
+// their prefix when tokenized, so they only match the tag itself
+type TermNode struct {
+	Term SearchTerm
+	// rune offsets of the term in the query
+	Pos int
+	End int
+}
+
+// FieldNode compares a numeric tweet field, e.g. faves:>100 or after:2018-01-01
+type FieldNode struct {
+	Field string
+	Op string
+	Value int64
+}
+
+// HasNode matches tweets with attached media, e.g. has:media or has:video
+type HasNode struct {
+	Kind string
+}
+
+func (n AndNode) Matches(tweet MyTweet, tokens []string) bool {
+	for _, node := range n.Nodes {
+		if node.Matches(tweet, tokens) == false {
+			return false
+		}
+	}
+	return true
+}
+
+func (n OrNode) Matches(tweet MyTweet, tokens []string) bool {
+	for _, node := range n.Nodes {
+		if node.Matches(tweet, tokens) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n NotNode) Matches(tweet MyTweet, tokens []string) bool {
+	return n.Node.Matches(tweet, tokens) == false
+}
+
+func (n TermNode) Matches(tweet MyTweet, tokens []string) bool {
+	return n.Term.MatchesTokens(tokens)
+}
+
+func (n FieldNode) Matches(tweet MyTweet, tokens []string) bool {
+	var val int64
+	switch n.Field {
+	case "faves":
+		val = int64(tweet.Faves)
+	case "rts":
+		val = int64(tweet.Rts)
+	case "created":
+		val = tweet.Created
+	}
+
+	switch n.Op {
+	case ">":
+		return val > n.Value
+	case ">=":
+		return val >= n.Value
+	case "<":
+		return val < n.Value
+	case "<=":
+		return val <= n.Value
+	}
+	return val == n.Value
+}
+
+func (n HasNode) Matches(tweet MyTweet, tokens []string) bool {
+	for _, m := range tweet.Media {
+		if n.Kind == "media" || m.Type == n.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchSyntaxError is returned for queries that cannot be parsed
+type SearchSyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (err *SearchSyntaxError) Error() string {
+	return fmt.Sprintf("search syntax error at %v: %v", err.Pos, err.Msg)
+}
+
+type searchToken struct {
+	kind string // "word", "phrase", "(", ")", "-", "OR"
+	text string
+	pos int
+}
+
+// ParseSearch parses a search query:
+//
+//	words "quoted phrases" a OR b -excluded (grouped OR terms)
+//	prefix* fuzzy~ fuzzy~2 (within 1 or 2 edits)
+//	#hashtag @mention has:media has:photo has:video has:animated_gif
+//	faves:>100 rts:<=10 faves:5 before:2018-01-31 after:2018-01-01
+//
+// Terms next to each other must all match. A nil node is returned for an
+// empty query.
+func ParseSearch(search string) (SearchNode, error) {
+	tokens, err := lexSearch(search)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	p := &searchParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return node, nil
+}
+
+func lexSearch(search string) ([]searchToken, error) {
+	tokens := []searchToken{}
+	runes := []rune(search)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, searchToken{kind: string(r), text: string(r), pos: i})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, &SearchSyntaxError{Pos: i, Msg: "unterminated quote"}
+			}
+			tokens = append(tokens, searchToken{kind: "phrase", text: string(runes[i + 1 : end]), pos: i})
+			i = end + 1
+		case r == '-' && (i == 0 || isSearchBoundary(runes[i - 1])):
+			tokens = append(tokens, searchToken{kind: "-", text: "-", pos: i})
+			i++
+		default:
+			end := i
+			for end < len(runes) && unicode.IsSpace(runes[end]) == false && isSearchDelim(runes[end]) == false {
+				end++
+			}
+			word := string(runes[i:end])
+			kind := "word"
+			if word == "OR" {
+				kind = "OR"
+			}
+			tokens = append(tokens, searchToken{kind: kind, text: word, pos: i})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+func isSearchDelim(r rune) bool {
+	return r == '(' || r == ')' || r == '"'
+}
+
+func isSearchBoundary(r rune) bool {
+	return unicode.IsSpace(r) || r == '('
+}
+
+type searchParser struct {
+	tokens []searchToken
+	pos int
+}
+
+func (p *searchParser) errorf(format string, args ...interface{}) error {
+	pos := 0
+	if p.pos < len(p.tokens) {
+		pos = p.tokens[p.pos].pos
+	} else if len(p.tokens) > 0 {
+		last := p.tokens[len(p.tokens) - 1]
+		pos = last.pos + len([]rune(last.text))
+	}
+	return &SearchSyntaxError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *searchParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].kind
+	}
+	return ""
+}
+
+func (p *searchParser) parseOr() (SearchNode, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	nodes := []SearchNode{node}
+	for p.peek() == "OR" {
+		p.pos++
+		node, err = p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return OrNode{Nodes: nodes}, nil
+}
+
+func (p *searchParser) parseAnd() (SearchNode, error) {
+	nodes := []SearchNode{}
+	for {
+		kind := p.peek()
+		if kind == "" || kind == ")" || kind == "OR" {
+			break
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 0 {
+		return nil, p.errorf("expected a search term")
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return AndNode{Nodes: nodes}, nil
+}
+
+func (p *searchParser) parseUnary() (SearchNode, error) {
+	if p.peek() == "-" {
+		p.pos++
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return NotNode{Node: node}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *searchParser) parsePrimary() (SearchNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, p.errorf("expected a search term")
+	}
+	tok := p.tokens[p.pos]
+	switch tok.kind {
+	case "(":
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return node, nil
+	case "phrase":
+		p.pos++
+		return termNode(tok, true)
+	case "word":
+		p.pos++
+		if parts := strings.SplitN(tok.text, ":", 2); len(parts) == 2 {
+			if node, known, err := fieldNode(tok, strings.ToLower(parts[0]), parts[1]); known {
+				return node, err
+			}
+		}
+		return termNode(tok, false)
+	}
+	return nil, p.errorf("unexpected %q", tok.text)
+}
+
+func termNode(tok searchToken, quoted bool) (SearchNode, error) {
+	term := SearchTerm{
+		Text: tok.text,
+		Quoted: quoted,
+	}
+	text := tok.text
+	if quoted == false {
+		if strings.HasSuffix(text, "*") {
+			term.Prefix = true
+			text = strings.TrimRight(text, "*")
+		} else if i := strings.LastIndex(text, "~"); i >= 0 && isDigits(text[i + 1:]) {
+			fuzzy := 1
+			if dist := text[i + 1:]; dist != "" {
+				var err error
+				if fuzzy, err = strconv.Atoi(dist); err != nil || fuzzy < 1 || fuzzy > AppConfig.MaxFuzzyDistance {
+					return nil, &SearchSyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("fuzzy distance must be 1 to %v, got %q", AppConfig.MaxFuzzyDistance, dist)}
+				}
+			}
+			term.Fuzzy = fuzzy
+			text = text[:i]
+		}
+	}
+
+	term.Tokens = tokenize(text)
+	if len(term.Tokens) == 0 {
+		return nil, &SearchSyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("nothing searchable in %q", tok.text)}
+	}
+	return TermNode{Term: term, Pos: tok.pos, End: tok.pos + len([]rune(tok.text))}, nil
+}
+
+// isDigits is true for "" too, a bare ~ means the default distance while a
+// ~ inside a word such as foo~bar is just punctuation
+func isDigits(text string) bool {
+	for _, r := range text {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldNode parses field:value terms, known is false for unrecognized fields
+// which are then searched as plain words
+func fieldNode(tok searchToken, field string, value string) (node SearchNode, known bool, err error) {
+	fail := func(msg string) (SearchNode, bool, error) {
+		return nil, true, &SearchSyntaxError{Pos: tok.pos, Msg: msg}
+	}
+
+	switch field {
+	case "has":
+		switch value = strings.ToLower(value); value {
+		case "media", "photo", "video", "animated_gif":
+			return HasNode{Kind: value}, true, nil
+		}
+		return fail(fmt.Sprintf("unknown has: value %q", value))
+	case "faves", "rts":
+		op := ""
+		for _, prefix := range []string{">=", "<=", ">", "<"} {
+			if strings.HasPrefix(value, prefix) {
+				op = prefix
+				value = value[len(prefix):]
+				break
+			}
+		}
+		num, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || num < 0 {
+			return fail(fmt.Sprintf("%v: expects a number, got %q", field, value))
+		}
+		return FieldNode{Field: field, Op: op, Value: num}, true, nil
+	case "before", "after":
+		date, err := time.Parse(SEARCH_DATE_FORMAT, value)
+		if err != nil {
+			return fail(fmt.Sprintf("%v: expects a YYYY-MM-DD date, got %q", field, value))
+		}
+		// before: excludes the given day, after: includes it
+		if field == "before" {
+			return FieldNode{Field: "created", Op: "<", Value: date.Unix()}, true, nil
+		}
+		return FieldNode{Field: "created", Op: ">=", Value: date.Unix()}, true, nil
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,31 @@
+package tapp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSearchTilde(t *testing.T) {
+	newTestRouter(t)
+	for search, want := range map[string]int{
+		"foo~bar": 0,
+		"foo~": 1,
+		"foo~2": 2,
+	} {
+		node, err := ParseSearch(search)
+		if err != nil {
+			t.Errorf("ParseSearch(%q) = %v", search, err)
+			continue
+		}
+		term, ok := node.(TermNode)
+		if ok == false || term.Term.Fuzzy != want {
+			t.Errorf("ParseSearch(%q) = %+v, want fuzzy %v", search, node, want)
+		}
+	}
+	if node, _ := ParseSearch("foo~bar"); strings.Join(node.(TermNode).Term.Tokens, " ") != "foo bar" {
+		t.Errorf("foo~bar tokens = %v", node.(TermNode).Term.Tokens)
+	}
+	if _, err := ParseSearch("foo~9"); err == nil {
+		t.Errorf("ParseSearch(foo~9) = nil, want a distance error")
+	}
+}
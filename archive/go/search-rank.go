@@ -0,0 +1,131 @@
+package tapp
+
+import (
+	"math"
+	"sort"
+	"errors"
+	"strings"
+)
+
+const (
+	SEARCH_ORDER_RELEVANCE = "relevance"
+	SEARCH_DEFAULT_ORDER = "-Faves"
+	BM25_K1 = 1.2
+	BM25_B = 0.75
+	// phrase matches score as if their words were this many times rarer
+	PHRASE_BOOST = 2.0
+)
+
+var ErrInvalidSearchOrder = errors.New("invalid search order")
+
+// searchOrders are the stored properties search results may be sorted by,
+// each also allowed with a "-" prefix for descending
+var searchOrders = map[string]bool{
+	"Id": true,
+	"Created": true,
+	"Faves": true,
+	"Rts": true,
+	"Ratio": true,
+}
+
+// validateSearchOrder checks order against the allow-list. An empty order
+// is the search page's default, most faved first, and results are only
+// ranked by relevance when asked for.
+func validateSearchOrder(order string) (string, error) {
+	if order == "" {
+		return SEARCH_DEFAULT_ORDER, nil
+	}
+	field := strings.TrimPrefix(order, "-")
+	if field == SEARCH_ORDER_RELEVANCE {
+		return SEARCH_ORDER_RELEVANCE, nil
+	}
+	if searchOrders[field] == false {
+		return "", ErrInvalidSearchOrder
+	}
+	return order, nil
+}
+
+// rankTweets scores tweets against the non-excluded terms of node with BM25
+// and sorts them best first, newest first on ties. popularity weights an
+// extra ln(1 + Faves + Rts) added to each score.
+func rankTweets(tweets []MyTweet, node SearchNode, match *indexMatch, stats IndexStats, popularity float64) []float64 {
+	avgLen := 1.0
+	if stats.Docs > 0 && stats.Tokens > 0 {
+		avgLen = float64(stats.Tokens) / float64(stats.Docs)
+	}
+	terms := positiveSearchTerms(node)
+
+	scores := make([]float64, len(tweets))
+	for i, tweet := range tweets {
+		tokens := tokenize(tweet.Text)
+		docLen := float64(len(tokens))
+		score := 0.0
+		for _, term := range terms {
+			tf := float64(len(term.FindTokens(tokens)))
+			if tf == 0 {
+				continue
+			}
+			idf := 0.0
+			for _, token := range term.IndexTokens() {
+				idf += bm25Idf(stats.Docs, int64(len(match.Postings[token])))
+			}
+			if len(term.Tokens) > 1 {
+				idf *= PHRASE_BOOST
+			}
+			score += idf * (tf * (BM25_K1 + 1)) / (tf + BM25_K1 * (1 - BM25_B + BM25_B * docLen / avgLen))
+		}
+		if popularity > 0 {
+			score += popularity * math.Log1p(float64(tweet.Faves + tweet.Rts))
+		}
+		scores[i] = score
+	}
+
+	sort.Sort(rankedTweets{tweets: tweets, scores: scores})
+	return scores
+}
+
+func bm25Idf(docs int64, freq int64) float64 {
+	if freq > docs {
+		docs = freq
+	}
+	return math.Log(1 + (float64(docs - freq) + 0.5) / (float64(freq) + 0.5))
+}
+
+// positiveSearchTerms lists the terms of node that are not excluded
+func positiveSearchTerms(node SearchNode) []SearchTerm {
+	terms := []SearchTerm{}
+	switch n := node.(type) {
+	case TermNode:
+		terms = append(terms, n.Term)
+	case AndNode:
+		for _, child := range n.Nodes {
+			terms = append(terms, positiveSearchTerms(child)...)
+		}
+	case OrNode:
+		for _, child := range n.Nodes {
+			terms = append(terms, positiveSearchTerms(child)...)
+		}
+	}
+	return terms
+}
+
+type rankedTweets struct {
+	tweets []MyTweet
+	scores []float64
+}
+
+func (r rankedTweets) Len() int {
+	return len(r.tweets)
+}
+
+func (r rankedTweets) Less(i, j int) bool {
+	if r.scores[i] != r.scores[j] {
+		return r.scores[i] > r.scores[j]
+	}
+	return r.tweets[i].Id > r.tweets[j].Id
+}
+
+func (r rankedTweets) Swap(i, j int) {
+	r.tweets[i], r.tweets[j] = r.tweets[j], r.tweets[i]
+	r.scores[i], r.scores[j] = r.scores[j], r.scores[i]
+}
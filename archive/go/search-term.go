@@ -1,10 +1,77 @@
 package tapp
 
-import ("regexp")
+import (
+	"strconv"
+	"strings"
+)
 
 type SearchTerm struct {
 	Text string
-	Upper string
 	Quoted bool
-	RegExp *regexp.Regexp
+	// normalized tokens, matched as a phrase
+	Tokens []string
+	// the last token matches any token starting with it (term*)
+	Prefix bool
+	// the last token matches tokens within this edit distance (term~1)
+	Fuzzy int
+}
+
+// MatchesTokens reports whether the term's tokens appear in order and next
+// to each other in tokens
+func (term SearchTerm) MatchesTokens(tokens []string) bool {
+	return len(term.FindTokens(tokens)) > 0
+}
+
+// FindTokens returns every index in tokens where the term's tokens start
+func (term SearchTerm) FindTokens(tokens []string) (found []int) {
+	if len(term.Tokens) == 0 {
+		return nil
+	}
+	for i := 0; i + len(term.Tokens) <= len(tokens); i++ {
+		match := true
+		for j := range term.Tokens {
+			if term.tokenMatches(j, tokens[i + j]) == false {
+				match = false
+				break
+			}
+		}
+		if match == true {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+func (term SearchTerm) tokenMatches(j int, token string) bool {
+	if j == len(term.Tokens) - 1 {
+		if term.Prefix {
+			return strings.HasPrefix(token, term.Tokens[j])
+		}
+		if term.Fuzzy > 0 {
+			return fuzzyMatches(token, term.Tokens[j], term.Fuzzy)
+		}
+	}
+	return token == term.Tokens[j]
+}
+
+// IndexTokens are the keys of the term's tokens in an indexMatch's postings;
+// an expanded last token is keyed with its * or ~N suffix
+func (term SearchTerm) IndexTokens() []string {
+	tokens := append([]string{}, term.Tokens...)
+	if last := len(tokens) - 1; last >= 0 && term.expanded() {
+		tokens[last] = term.patternKey()
+	}
+	return tokens
+}
+
+func (term SearchTerm) expanded() bool {
+	return term.Prefix || term.Fuzzy > 0
+}
+
+func (term SearchTerm) patternKey() string {
+	last := term.Tokens[len(term.Tokens) - 1]
+	if term.Prefix {
+		return last + "*"
+	}
+	return last + "~" + strconv.Itoa(term.Fuzzy)
 }
@@ -0,0 +1,260 @@
+package tapp
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"errors"
+	"reflect"
+	"strings"
+	"context"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"encoding/base64"
+	"path/filepath"
+)
+
+var ErrSecretNotFound = errors.New("tapp: secret not found")
+
+// SecretProvider looks up secrets by their config key, e.g.
+// consumerKeySecret
+type SecretProvider interface {
+	GetSecret(name string) (string, error)
+}
+
+// Secrets fill the secret settings missing from the config file and
+// environment
+var Secrets SecretProvider = EnvSecrets{}
+
+// EnvSecrets reads secrets from the environment, consumerKeySecret from
+// TAPP_CONSUMER_KEY_SECRET
+type EnvSecrets struct{}
+
+func (EnvSecrets) GetSecret(name string) (string, error) {
+	if val := os.Getenv(configEnv(name)); val != "" {
+		return val, nil
+	}
+	return "", ErrSecretNotFound
+}
+
+// FileSecrets keeps secrets in a json file, each sealed with a keyring from
+// the TAPP_SECRETS_KEY and TAPP_SECRETS_OLD_KEYS environment variables
+type FileSecrets struct {
+	mu sync.Mutex
+	path string
+	keys *Keyring
+	sealed map[string]string
+}
+
+// KeyringFromEnv is the secrets file keyring, TAPP_SECRETS_OLD_KEYS is a
+// comma separated list of keys rotated out
+func KeyringFromEnv() (*Keyring, error) {
+	old := []string{}
+	for _, key := range strings.Split(os.Getenv(SECRETS_OLD_KEYS_ENV), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			old = append(old, key)
+		}
+	}
+	keys, err := NewKeyring(os.Getenv(SECRETS_KEY_ENV), old...)
+	if err == ErrNoEncryptionKey {
+		return nil, fmt.Errorf("Error opening secrets file: %v is not set", SECRETS_KEY_ENV)
+	}
+	return keys, err
+}
+
+// OpenFileSecrets reads the secrets file at path, a missing file has no
+// secrets yet
+func OpenFileSecrets(path string, keys *Keyring) (*FileSecrets, error) {
+	s := &FileSecrets{path: path, keys: keys, sealed: map[string]string{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading secrets file %q: %v", path, err)
+	}
+	if err = json.Unmarshal(data, &s.sealed); err != nil {
+		return nil, fmt.Errorf("Error parsing secrets file %q: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *FileSecrets) GetSecret(name string) (string, error) {
+	s.mu.Lock()
+	encoded, ok := s.sealed[name]
+	s.mu.Unlock()
+	if ok == false {
+		return "", ErrSecretNotFound
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("Error decoding secret %v: %v", name, err)
+	}
+	return s.keys.Open(name, sealed)
+}
+
+// SetSecret seals value under the current key and saves the file
+func (s *FileSecrets) SetSecret(name string, value string) error {
+	sealed, err := s.keys.Seal(name, value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sealed[name] = base64.StdEncoding.EncodeToString(sealed)
+	return s.save()
+}
+
+// Rotate re-seals every secret not sealed with the current key, returning
+// how many were
+func (s *FileSecrets) Rotate() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rotated := 0
+	for name, encoded := range s.sealed {
+		sealed, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return 0, fmt.Errorf("Error decoding secret %v: %v", name, err)
+		}
+		if s.keys.Stale(sealed) == false {
+			continue
+		}
+		plain, err := s.keys.Open(name, sealed)
+		if err != nil {
+			return 0, err
+		}
+		if sealed, err = s.keys.Seal(name, plain); err != nil {
+			return 0, err
+		}
+		s.sealed[name] = base64.StdEncoding.EncodeToString(sealed)
+		rotated++
+	}
+	if rotated == 0 {
+		return 0, nil
+	}
+	return rotated, s.save()
+}
+
+// save replaces the file in one rename so a crash never leaves it half
+// written
+func (s *FileSecrets) save() error {
+	data, err := json.MarshalIndent(s.sealed, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path) + ".tmp")
+	if err != nil {
+		return fmt.Errorf("Error writing secrets file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error writing secrets file: %v", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("Error writing secrets file: %v", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// secretProvider is the file backend when the secretsFile setting is set,
+// otherwise the environment
+func (cfg *Config) secretProvider() (SecretProvider, error) {
+	if cfg.SecretsFile == "" {
+		return EnvSecrets{}, nil
+	}
+	keys, err := KeyringFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return OpenFileSecrets(cfg.SecretsFile, keys)
+}
+
+// applySecrets fills the secret settings left empty by the config file and
+// environment
+func (cfg *Config) applySecrets(secrets SecretProvider) error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := configKey(t.Field(i))
+		if key == "" || t.Field(i).Tag.Get("secret") != "true" || v.Field(i).IsZero() == false {
+			continue
+		}
+		val, err := secrets.GetSecret(key)
+		if err == ErrSecretNotFound {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Error reading secret %v: %v", key, err)
+		}
+		if err = setConfigField(v.Field(i), val); err != nil {
+			return fmt.Errorf("Error reading secret %v: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// rotateSecretsHandler re-seals everything still sealed with an old key, run
+// it after moving a key to the old keys and before dropping it for good
+func rotateSecretsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return MethodNotAllowed(r.Method, "POST")
+	}
+	rotated := struct {
+		Secrets int
+		TwitterAuths int
+	}{}
+
+	var err error
+	if file, ok := Secrets.(*FileSecrets); ok {
+		if rotated.Secrets, err = file.Rotate(); err != nil {
+			return fmt.Errorf("Error rotating secrets file: %v", err)
+		}
+	}
+	if rotated.TwitterAuths, err = rotateTwitterAuths(ctx); err != nil {
+		return fmt.Errorf("Error rotating twitter auths: %v", err)
+	}
+	applog.Infof(ctx, "rotated secrets: %+v", rotated)
+
+	rotatedJson, err := json.Marshal(rotated)
+	if err != nil {
+		return fmt.Errorf("Error marshaling json for rotation: %v", err)
+	}
+	_, err = w.Write(rotatedJson)
+	return err
+}
+
+// rotateTwitterAuths re-seals the stored access tokens not sealed with the
+// current encryption key
+func rotateTwitterAuths(ctx context.Context) (int, error) {
+	keys, err := sealKeyring()
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for _, account := range trackedAccounts() {
+		auth, err := TokenStorage.GetTwitterAuth(ctx, account)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return rotated, err
+		}
+		if keys.Stale(auth.Token) == false && keys.Stale(auth.Secret) == false {
+			continue
+		}
+		for part, sealed := range map[string]*[]byte{"token": &auth.Token, "secret": &auth.Secret} {
+			name := twitterAuthSecret(account, part)
+			plain, err := keys.Open(name, *sealed)
+			if err != nil {
+				return rotated, err
+			}
+			if *sealed, err = keys.Seal(name, plain); err != nil {
+				return rotated, err
+			}
+		}
+		if err = TokenStorage.PutTwitterAuth(ctx, *auth); err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+	return rotated, nil
+}
@@ -2,14 +2,15 @@ package tapp
 
 import (
 	"fmt"
+	"mime"
 	"time"
 	"math"
+	"sort"
 	"strings"
 	"regexp"
 	"context"
 	"path"
 	"bytes"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -18,129 +19,260 @@ import (
 	"encoding/csv"
 	"encoding/xml"
 	"archive/zip"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/urlfetch"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
-	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/file"
+	stdlog "log"
 	"github.com/ChimeraCoder/anaconda"
-	"cloud.google.com/go/storage"
-)
-
-var (
-	TwitterApi *anaconda.TwitterApi
-	MyToken Credentials
+	"google.golang.org/appengine"
 )
 
 type appEngineHandler func(context.Context, http.ResponseWriter, *http.Request) error
 
 func appHandler(handler appEngineHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := appengine.NewContext(r)
-		if err := handler(ctx, w, r); err != nil {
-			log.Errorf(ctx, "Handler error: %v", err)
-			http.Error(w, "Error", http.StatusInternalServerError)
+		ctx := newContext(r)
+		if account, ok := r.Context().Value(accountKey{}).(string); ok {
+			ctx = withAccount(ctx, account)
+		}
+		err := handler(ctx, w, r)
+		if err == nil {
+			return
+		}
+		httpErr, ok := err.(*HttpError)
+		if ok == false {
+			httpErr = &HttpError{Status: http.StatusInternalServerError, Msg: "Internal server error", Err: err}
 		}
+		if httpErr.Status >= http.StatusInternalServerError {
+			applog.Errorf(ctx, "Handler error: %v", err)
+		} else {
+			applog.Warningf(ctx, "Handler error: %v", err)
+		}
+		writeHttpError(w, r, httpErr)
 	}
 }
 
 func validateCron(handler appEngineHandler) appEngineHandler {
 	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 		isCron := r.Header.Get("X-Appengine-Cron")
-		if isCron != "true" {
-			log.Warningf(ctx, "unauthorized attempt to access cron /unretweet")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return nil
+		if isCron == "true" {
+			return handler(ctx, w, r)
 		}
-		return handler(ctx, w, r)
+		// scripts may trigger jobs with a cron scoped api token
+		if token, ok := bearerToken(r); ok {
+			if err := authorizeApiToken(ctx, token, SCOPE_CRON); err != nil {
+				applog.Warningf(ctx, "api token refused for cron %v", r.URL.Path)
+				return err
+			}
+			return handler(ctx, w, r)
+		}
+		applog.Warningf(ctx, "unauthorized attempt to access cron %v", r.URL.Path)
+		return Unauthorized("cron requests only")
 	}
 }
 
 func init() {
+	// self-hosted, cmd/tapp loads the config and mounts NewRouter itself
+	if appengine.IsAppEngine() == false {
+		return
+	}
+
+	cfg, err := LoadConfig(DefaultConfigPath())
+	if err != nil {
+		stdlog.Fatalf("Error loading config: %v", err)
+	}
+	if err = SetConfig(cfg); err != nil {
+		stdlog.Fatalf("%v", err)
+	}
+	http.Handle("/", NewRouter())
+}
+
+// NewRouter returns a mux with every tapp route registered, which can be
+// served directly or mounted on another mux
+func NewRouter() *http.ServeMux {
+	mux := http.NewServeMux()
+
 	// default pages
-	http.HandleFunc("/index.html", appHandler(indexHandler))
-	http.HandleFunc("/index", appHandler(indexHandler))
-	// handles all /.*
-	http.HandleFunc("/", appHandler(indexOrErrorHandler))
+	mux.HandleFunc("/index.html", appHandler(indexHandler))
+	mux.HandleFunc("/index", appHandler(indexHandler))
+	// handles all /.*, and /{screenName}/.* for every tracked account
+	mux.Handle("/", accountHandler(mux, appHandler(indexOrErrorHandler)))
 	// routes
-	http.HandleFunc("/latest", appHandler(indexHandler))
-	http.HandleFunc("/best", appHandler(indexHandler))
-	http.HandleFunc("/search", appHandler(indexHandler))
-	http.HandleFunc("/error", appHandler(indexHandler))
+	mux.HandleFunc("/latest", appHandler(indexHandler))
+	mux.HandleFunc("/best", appHandler(indexHandler))
+	mux.HandleFunc("/search", appHandler(indexHandler))
+	mux.HandleFunc("/error", appHandler(indexHandler))
 
 	// ajax calls
-	http.HandleFunc("/user", appHandler(userHandler))
-	http.HandleFunc("/tweet", appHandler(tweetHandler))
-	http.HandleFunc("/tweets/latest", appHandler(tweetsHandler))
-	http.HandleFunc("/tweets/best", appHandler(tweetsHandler))
-	http.HandleFunc("/tweets/search", appHandler(searchTweetsHandler))
+	mux.HandleFunc("/user", appHandler(userHandler))
+	mux.HandleFunc("/users", appHandler(usersHandler))
+	mux.HandleFunc("/tweet", appHandler(tweetHandler))
+	mux.HandleFunc("/tweets/latest", appHandler(tweetsHandler))
+	mux.HandleFunc("/tweets/best", appHandler(tweetsHandler))
+	mux.HandleFunc("/tweets/search", appHandler(searchTweetsHandler))
+	registerApiRoutes(mux)
 
 	// cron requests
-	http.HandleFunc("/fetch", appHandler(validateCron(fetchTweetsHandler)))
-	http.HandleFunc("/update/tweets", appHandler(validateCron(updateTweetsHandler)))
-	http.HandleFunc("/update/user", appHandler(validateCron(updateUserHandler)))
-	http.HandleFunc("/unretweet", appHandler(validateCron(unretweetHanlder)))
+	mux.HandleFunc("/fetch", appHandler(validateCron(jobHandler("/fetch"))))
+	mux.HandleFunc("/update/tweets", appHandler(validateCron(jobHandler("/update/tweets"))))
+	mux.HandleFunc("/update/user", appHandler(validateCron(jobHandler("/update/user"))))
+	mux.HandleFunc("/retry/media", appHandler(validateCron(jobHandler("/retry/media"))))
+	mux.HandleFunc("/audit/media", appHandler(validateCron(jobHandler("/audit/media"))))
+	mux.HandleFunc("/unretweet", appHandler(validateCron(jobHandler("/unretweet"))))
+	mux.HandleFunc("/migrate/owners", appHandler(validateCron(jobHandler("/migrate/owners"))))
 
 	// admin page requests
-	http.HandleFunc("/admin", appHandler(indexHandler))
-	http.HandleFunc("/admin/archive/import", appHandler(archiveImportHandler))
-	http.HandleFunc("/admin/archive/export", appHandler(archiveExportHandler))
-	http.HandleFunc("/admin/delete", appHandler(toggleDeletedHandler))
+	mux.HandleFunc("/admin/login", appHandler(loginHandler))
+	mux.HandleFunc("/admin/logout", appHandler(logoutHandler))
+	mux.HandleFunc("/admin", appHandler(validateAdmin("", indexHandler)))
+	mux.HandleFunc("/admin/archive/import", appHandler(validateAdmin(SCOPE_ADMIN_ARCHIVE, archiveImportHandler)))
+	mux.HandleFunc("/admin/archive/export", appHandler(validateAdmin(SCOPE_ADMIN_ARCHIVE, archiveExportHandler)))
+	mux.HandleFunc("/admin/delete", appHandler(validateAdmin(SCOPE_ADMIN_DELETE, toggleDeletedHandler)))
+	mux.HandleFunc("/admin/jobs", appHandler(validateAdmin(SCOPE_READ, jobsHandler)))
+	mux.HandleFunc("/admin/config", appHandler(validateAdmin(SCOPE_READ, configHandler)))
+	mux.HandleFunc("/admin/search/reindex", appHandler(validateAdmin("", reindexHandler)))
+	mux.HandleFunc("/admin/tokens", appHandler(validateAdmin("", tokensHandler)))
+	mux.HandleFunc("/admin/tokens/revoke", appHandler(validateAdmin("", revokeTokenHandler)))
+	mux.HandleFunc("/admin/connect", appHandler(validateAdmin("", connectHandler)))
+	mux.HandleFunc("/admin/connect/callback", appHandler(validateAdmin("", connectCallbackHandler)))
+	mux.HandleFunc("/admin/secrets/rotate", appHandler(validateAdmin("", rotateSecretsHandler)))
+	mux.HandleFunc("/admin/media/audit", appHandler(validateAdmin(SCOPE_ADMIN_ARCHIVE, mediaAuditHandler)))
+	mux.HandleFunc("/admin/users/history", appHandler(validateAdmin(SCOPE_READ, userHistoryHandler)))
 
 	// media
-	http.HandleFunc("/media", appHandler(mediaHandler))
+	mux.HandleFunc("/media", appHandler(mediaHandler))
 
 	// rss feed
-	http.HandleFunc("/feed/latest.xml", appHandler(feedHandler))
+	mux.HandleFunc("/feed/latest.xml", appHandler(feedHandler))
 
-	TwitterApi, MyToken = LoadCredentials(false)
+	return mux
 }
 
+// mediaHandler streams an archived media file, answering conditional and
+// range requests from the blob's ETag, modified time and size
 func mediaHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	filePath := r.URL.Query().Get("file")
 	if filePath == "" {
-		return fmt.Errorf("No file path passed")
+		return BadRequest("No file path passed")
+	}
+	if validMediaPath(filePath) == false {
+		return BadRequest("Invalid media path: %q", filePath)
 	}
 
-	bucket, err := getBucket(ctx)
-	if err != nil {
-		return fmt.Errorf("Error getting bucket: %v", err)
+	size := r.URL.Query().Get("size")
+	if size != "" && validThumbnailSize(size) == false {
+		return BadRequest("Unknown size: %q", size)
 	}
 
-	rc, err := bucket.Object(filePath).NewReader(ctx)
+	// media archived before content addressing is stored under its path
+	name := filePath
+	ref, err := getMediaRef(ctx, filePath, size)
 	if err != nil {
-		return fmt.Errorf("readFile: unable to open file %q: %v", filePath, err)
+		return fmt.Errorf("Error getting media ref: %v", err)
+	}
+	if ref != nil {
+		name = mediaBlobName(ref.Hash)
 	}
 
+	rc, info, err := MediaStorage.Get(ctx, name)
+	if err == ErrBlobNotFound {
+		return NotFound("File not found: %v", filePath)
+	} else if err != nil {
+		return Upstream(err, "Unable to open file %q", filePath)
+	}
 	defer rc.Close()
-	slurp, err := ioutil.ReadAll(rc)
-	if err != nil {
-		return fmt.Errorf("readFile: unable to read data from file %q: %v", filePath, err)
+
+	if ref != nil {
+		// content addressed, so the hash is all the ETag needs
+		info.ETag = ref.Hash
+		if ref.ContentType != "" {
+			info.ContentType = ref.ContentType
+		}
+	}
+	contentType := info.ContentType
+	if contentType == "" || contentType == "application/octet-stream" {
+		if byExt := mime.TypeByExtension(path.Ext(filePath)); byExt != "" {
+			contentType = byExt
+		}
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
 	}
+	if info.ETag != "" {
+		w.Header().Set("ETag", `"` + info.ETag + `"`)
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(MEDIA_MAX_AGE.Seconds())))
+	http.ServeContent(w, r, path.Base(filePath), info.Updated, rc)
+	return nil
+}
 
-	_, err = w.Write(slurp)
-	return err
+// getMediaRef is the ref of the filePath's thumbnail at size, falling back
+// to filePath's own for images no larger than size, nil when neither exists
+func getMediaRef(ctx context.Context, filePath string, size string) (*MediaRef, error) {
+	if size != "" {
+		ref, err := MediaRefStorage.GetMediaRef(ctx, thumbnailPath(filePath, size))
+		if err == nil {
+			return ref, nil
+		} else if err != ErrNotFound {
+			return nil, err
+		}
+	}
+	ref, err := MediaRefStorage.GetMediaRef(ctx, filePath)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return ref, err
+}
+
+// validMediaPath only lets /media read the tweet and user media in the store
+func validMediaPath(filePath string) bool {
+	if validBlobName(filePath) == false {
+		return false
+	}
+	return strings.HasPrefix(filePath, "status/") || strings.HasPrefix(filePath, "user/")
 }
 
 func toggleDeletedHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return MethodNotAllowed(r.Method, "POST")
+	}
 	params := r.URL.Query()
-	id, _ := strconv.Atoi(params.Get("id"))
-	tweet := MyTweet{Id: int64(id)}
-	log.Infof(ctx, "deleting tweet: %+v", tweet)
+	id, err := strconv.ParseInt(params.Get("id"), 10, 64)
+	if err != nil {
+		return BadRequest("Invalid tweet id: %q", params.Get("id"))
+	}
+	applog.Infof(ctx, "deleting tweet: %v", id)
 
-	if err := datastore.Get(ctx, tweet.GetKey(ctx), &tweet); err != nil {
-		//TODO: return statusnotfound
+	tweet, err := TweetStorage.GetTweet(ctx, id)
+	if err == ErrNotFound {
+		return NotFound("Tweet %v not found", id)
+	} else if err != nil {
 		return fmt.Errorf("Error getting tweet from datastore: %v", err)
 	}
 	tweet.Deleted = !tweet.Deleted
 
-	_, err := datastore.Put(ctx, tweet.GetKey(ctx), &tweet)
-	return err
+	if err = storeTweets(ctx, []MyTweet{*tweet}); err != nil {
+		return err
+	}
+	owner := tweet.Owner
+	if owner == "" {
+		owner = defaultAccount()
+	}
+	clearTweetCaches(ctx, owner)
+	return nil
+}
+
+func reindexHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return MethodNotAllowed(r.Method, "POST")
+	}
+	if err := rebuildSearchIndex(ctx); err != nil {
+		return fmt.Errorf("Error rebuilding search index: %v", err)
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
 }
 
 func feedHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	tweets, err := getLatestTweets(ctx, 0)
+	account := accountFrom(ctx)
+	tweets, err := getLatestTweets(ctx, account, 0)
 	if err != nil {
 		return fmt.Errorf("Error getting latest tweets: %v", err)
 	}
@@ -162,11 +294,11 @@ func feedHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) er
 
 	var user *User
 	var last *MyTweet
-	user, err = getUser(ctx)
+	user, err = getUser(ctx, account)
 	if err != nil {
 		return fmt.Errorf("Error getting user: %v", err)
 	}
-	last, err = getLatestTweet(ctx)
+	last, err = getLatestTweet(ctx, account)
 	if err != nil {
 		return fmt.Errorf("Error getting latest tweet: %v", err)
 	}
@@ -179,7 +311,7 @@ func feedHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) er
 			Link: Link{tweet.Url, "alternate"},
 			Id: tweet.IdStr,
 			Updated: t.Format(XML_ATOM_TIME_FORMAT),
-			Summary: tweet.Text[:min(len(tweet.Text), SUMMARY_LENGTH)],
+			Summary: tweet.Text[:min(len(tweet.Text), AppConfig.SummaryLength)],
 			//Content: "<![CDATA[ " + strings.Replace(tweet.Text, "\n", "\n<br/>", -1) + " ]]>",
 			Content: "<![CDATA[ " + tweet.Text + " ]]>",
 			Author: "@" + user.ScreenName,
@@ -229,15 +361,21 @@ func feedHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) er
 }
 
 func archiveExportHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	query := datastore.NewQuery("MyTweet").Order("Created")
-	tweets := []MyTweet{}
-	_, err := query.GetAll(ctx, &tweets)
+	account, err := requestAccount(ctx, r)
+	if err != nil {
+		return err
+	}
+	tweets, err := TweetStorage.QueryTweets(ctx, TweetQuery{
+		Owner: account,
+		IncludeDeleted: true,
+		Order: []string{"Created"},
+	})
 
 	if err != nil {
 		return fmt.Errorf("Error fetching tweets: %v", err)
 	}
 
-	user, err := getUser(ctx)
+	user, err := getUser(ctx, account)
 	if err != nil {
 		return fmt.Errorf("Error fetching user: %v", err)
 	}
@@ -293,6 +431,13 @@ func archiveExportHandler(ctx context.Context, w http.ResponseWriter, r *http.Re
 }
 
 func archiveImportHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return MethodNotAllowed(r.Method, "POST")
+	}
+	account, err := requestAccount(ctx, r)
+	if err != nil {
+		return err
+	}
 	reader := csv.NewReader(r.Body)
 
 	records, err := reader.ReadAll()
@@ -303,8 +448,8 @@ func archiveImportHandler(ctx context.Context, w http.ResponseWriter, r *http.Re
 	if len(records) > 0 {
 		headers := records[0]
 		rows := records[1:]
-		log.Infof(ctx, "Import headers: %v", headers)
-		log.Infof(ctx, "Import row count: %v", len(rows))
+		applog.Infof(ctx, "Import headers: %v", headers)
+		applog.Infof(ctx, "Import row count: %v", len(rows))
 		var (
 			//ids map[string]bool = make(map[string]bool)
 			rowMaps []map[string]string = make([]map[string]string, len(rows))
@@ -329,22 +474,28 @@ func archiveImportHandler(ctx context.Context, w http.ResponseWriter, r *http.Re
 				id, _ := strconv.Atoi(row["tweet_id"])
 				tweets = append(tweets, MyTweet{
 					Id: int64(id),
+					Owner: account,
 					IdStr: row["tweet_id"],
 					Created: parseTimestamp(row["timestamp"], ARCHIVE_TIME_FORMAT).Unix(),
 					Updated: time.Now().Unix(),
-					Url: TWITTER_URL + MyToken.ScreenName + "/status/" + row["tweet_id"],
+					Url: TWITTER_URL + account + "/status/" + row["tweet_id"],
 					Deleted: false,
 					Media: nil,
 				})
 			}
 		}
 
-		log.Infof(ctx, "importable rows: %v", len(tweets))
-		tweets, err = checkTweets(ctx, tweets)
+		applog.Infof(ctx, "importable rows: %v", len(tweets))
+		twitterApi, err := twitterApiFor(ctx, account)
+		if err != nil {
+			return err
+		}
+		defer twitterApi.Close()
+		tweets, err = checkTweets(ctx, twitterApi, account, tweets)
 		if err != nil {
 			return fmt.Errorf("Error checking tweets from csv file: %v", err)
 		}
-		log.Infof(ctx, "checked tweets: %v. Storing...", len(tweets))
+		applog.Infof(ctx, "checked tweets: %v. Storing...", len(tweets))
 
 		err = storeTweets(ctx, tweets)
 		if err != nil {
@@ -358,11 +509,14 @@ func archiveImportHandler(ctx context.Context, w http.ResponseWriter, r *http.Re
 
 func tweetHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	params := r.URL.Query()
-	id, _ := strconv.Atoi(params.Get("id"))
-	tweet := MyTweet{Id: int64(id)}
-
-	if err := datastore.Get(ctx, tweet.GetKey(ctx), &tweet); err != nil {
-		//TODO: return statusnotfound
+	id, err := strconv.ParseInt(params.Get("id"), 10, 64)
+	if err != nil {
+		return BadRequest("Invalid tweet id: %q", params.Get("id"))
+	}
+	tweet, err := TweetStorage.GetTweet(ctx, id)
+	if err == ErrNotFound {
+		return NotFound("Tweet %v not found", id)
+	} else if err != nil {
 		return fmt.Errorf("Error getting tweet from datastore: %v", err)
 	}
 
@@ -378,13 +532,40 @@ func tweetHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) e
 func searchTweetsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	params := r.URL.Query()
 	page, _ := strconv.Atoi(params.Get("page"))
-	tweets, err := getSearchTweets(ctx, page, params.Get("search"), params.Get("order"))
+	popularity, _ := strconv.ParseFloat(params.Get("popularity"), 64)
+	limit, err := pageSize(params)
 	if err != nil {
-		return fmt.Errorf("Error searching tweets: %v", err)
+		return BadRequest("%v", err)
+	}
+	_, legacy := params["page"]
+
+	opts := SearchOptions{
+		Owner: accountFrom(ctx),
+		Search: params.Get("search"),
+		Order: params.Get("order"),
+		Page: page,
+		Limit: limit,
+		Popularity: popularity,
+	}
+	if legacy == false {
+		opts.Cursor = params.Get("cursor")
+	}
+	result, err := getSearchTweets(ctx, opts)
+	if err != nil {
+		return searchError(err, opts)
 	}
 
 	var tweetJson []byte
-	tweetJson, err = json.Marshal(tweets)
+	if legacy {
+		// ?page= keeps the original bare array, with the rest in headers
+		w.Header().Set("X-Total-Count", strconv.Itoa(result.Total))
+		if result.Suggestion != "" {
+			w.Header().Set("X-Did-You-Mean", url.QueryEscape(result.Suggestion))
+		}
+		tweetJson, err = json.Marshal(result.Hits)
+	} else {
+		tweetJson, err = json.Marshal(result)
+	}
 	if err != nil {
 		return fmt.Errorf("Error marshaling json for tweets: %v", err)
 	}
@@ -400,31 +581,34 @@ func tweetsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request)
 		err error
 	)
 
-	i, _ := strconv.Atoi(params.Get("page"))
 	which := strings.Replace(path.Clean(r.URL.Path), "/tweets/", "", 1)
-	_, err = memcache.JSON.Get(ctx, MEMCACHE_TWEETS_KEY + which, &tweets)
+	// old clients send ?page= or nothing and expect a bare array
+	_, cursor := params["cursor"]
+	_, limit := params["limit"]
+	if cursor || limit {
+		return tweetPageHandler(ctx, w, params, which)
+	}
+
+	account := accountFrom(ctx)
+	i, _ := strconv.Atoi(params.Get("page"))
+	err = cache.Get(ctx, tweetsCacheKey(MEMCACHE_TWEETS_KEY, account, which), &tweets)
 	if i > 0 || tweets == nil || err != nil {
 		switch which {
 		case "best":
-			tweets, err = getBestTweets(ctx, i)
+			tweets, err = getBestTweets(ctx, account, i)
 		case "latest":
-			tweets, err = getLatestTweets(ctx, i)
+			tweets, err = getLatestTweets(ctx, account, i)
 		// case "search":
 		// 	tweets, err = getSearchTweets(ctx, i, params.Get("search"), params.Get("order"))
 		default:
-			//TODO: return bad request
-			return fmt.Errorf("Error invalid tweet type: %v", which)
+			return NotFound("Unknown tweet list: %v", which)
 		}
 
 		if err != nil {
 			return fmt.Errorf("Error getting %v tweets: %v", which, err)
 		}
 
-		store := &memcache.Item{
-			Key: MEMCACHE_TWEETS_KEY + which,
-			Object: tweets,
-		}
-		memcache.JSON.Set(ctx, store)
+		cache.Set(ctx, tweetsCacheKey(MEMCACHE_TWEETS_KEY, account, which), tweets)
 	}
 
 	var tweetJson []byte
@@ -437,11 +621,56 @@ func tweetsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	return err
 }
 
+// tweetPageHandler serves cursor paged tweets, ?cursor= and ?limit= select
+// the page
+func tweetPageHandler(ctx context.Context, w http.ResponseWriter, params url.Values, which string) error {
+	order, ok := tweetOrders[which]
+	if ok == false {
+		return NotFound("Unknown tweet list: %v", which)
+	}
+	limit, err := pageSize(params)
+	if err != nil {
+		return BadRequest("%v", err)
+	}
+
+	page, err := getTweetPage(ctx, accountFrom(ctx), order, params.Get("cursor"), limit)
+	if err == ErrInvalidCursor {
+		return BadRequest("%v", err)
+	} else if err != nil {
+		return fmt.Errorf("Error getting %v tweets: %v", which, err)
+	}
+
+	pageJson, err := json.Marshal(page)
+	if err != nil {
+		return fmt.Errorf("Error marshaling json for tweets: %v", err)
+	}
+
+	_, err = w.Write(pageJson)
+	return err
+}
+
+// tweetsCacheKey is the cache key of an account's tweet list
+func tweetsCacheKey(prefix string, account string, which string) string {
+	return prefix + strings.ToLower(account) + "." + which
+}
+
+// pageSize reads the ?limit= page size, defaulting to AppConfig.TweetsToFetch
+func pageSize(params url.Values) (int, error) {
+	if params.Get("limit") == "" {
+		return AppConfig.TweetsToFetch, nil
+	}
+	limit, err := strconv.Atoi(params.Get("limit"))
+	if err != nil || limit < 1 {
+		return 0, ErrInvalidPageSize
+	}
+	return min(limit, AppConfig.MaxPageSize), nil
+}
+
 func userHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	user, err := getUser(ctx)
+	user, err := getUser(ctx, accountFrom(ctx))
 
 	if err != nil {
-		return fmt.Errorf("Error getting user: %v", err)
+		return Upstream(err, "Error getting user")
 	}
 
 	var userJson []byte
@@ -454,28 +683,37 @@ func userHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) er
 	return err
 }
 
+func usersHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	users, err := getTrackedUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("Error getting users: %v", err)
+	}
+
+	usersJson, err := json.Marshal(users)
+	if err != nil {
+		return fmt.Errorf("Error marshaling json for users: %v", err)
+	}
+
+	_, err = w.Write(usersJson)
+	return err
+}
+
 func indexOrErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	name := path.Clean(r.URL.Path)
 	if r.Method == "GET" {
 		reg, _ := regexp.Compile("/tweet/[0-9]+")
 		if name == "/" || reg.MatchString(name) {
-			indexHandler(ctx, w, r)
-		} else if name == "/favicon.ico" {
-			w.WriteHeader(http.StatusNotFound)
-		} else {
-			//TODO: make /error/404 or something...
-			http.Redirect(w, r, "/error", http.StatusMovedPermanently)
+			return indexHandler(ctx, w, r)
 		}
-		return nil
+		return NotFound("Page not found: %v", name)
 	}
-	//TODO: wrong method error
-	return fmt.Errorf("Error wrong method: %v", r.Method)
+	return MethodNotAllowed(r.Method, "GET")
 }
 
 func indexHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	user, err := getUser(ctx)
+	user, err := getUser(ctx, accountFrom(ctx))
 	if err != nil {
-		return fmt.Errorf("Error fetching user: %v", err)
+		return Upstream(err, "Error fetching user")
 	}
 
 	page := "html/main.html"
@@ -490,15 +728,27 @@ func indexHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) e
 		return fmt.Errorf("Error parsing template: %v", err)
 	}
 
+	// only the admin page shows jobs, and it still renders without them
+	var jobs []JobStatus
+	if page == "html/admin.html" {
+		if jobs, err = Jobs.Status(ctx); err != nil {
+			applog.Errorf(ctx, "Error getting job statuses: %v", err)
+		}
+	}
+
 	mainPage := struct {
 		User *User
+		Accounts []string
 		GaKey string
 		HasGaKey bool
+		Jobs []JobStatus
 	} {
 		User: user,
-		GaKey: MyToken.GaKey,
+		Accounts: trackedAccounts(),
+		Jobs: jobs,
+		GaKey: AppConfig.GaKey,
 		// disable if localhost or no ga key supplied in credentials
-		HasGaKey: MyToken.GaKey != "" && isLocalhost(r.RemoteAddr) == false,
+		HasGaKey: AppConfig.GaKey != "" && isLocalhost(r.RemoteAddr) == false,
 	}
 
 	if err = temp.Execute(w, mainPage); err != nil {
@@ -507,25 +757,76 @@ func indexHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) e
 	return nil
 }
 
-func unretweetHanlder(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	twitterApi, myToken := LoadCredentials(true)
-	twitterApi.HttpClient.Transport = &urlfetch.Transport{Context: ctx}
+func jobHandler(name string) appEngineHandler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		err := Jobs.Run(ctx, name)
+		if err == ErrJobRunning {
+			applog.Warningf(ctx, "job %v already running", name)
+			return &HttpError{Status: http.StatusConflict, Msg: "Job already running"}
+		} else if err != nil {
+			return fmt.Errorf("Error running job %v: %v", name, err)
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+}
+
+func jobsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	statuses, err := Jobs.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("Error getting job statuses: %v", err)
+	}
+	jobsJson, err := json.Marshal(statuses)
+	if err != nil {
+		return fmt.Errorf("Error marshaling json for jobs: %v", err)
+	}
+
+	_, err = w.Write(jobsJson)
+	return err
+}
+
+// configHandler shows the effective config, without the secrets
+func configHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	configJson, err := json.Marshal(AppConfig.view())
+	if err != nil {
+		return fmt.Errorf("Error marshaling json for config: %v", err)
+	}
+
+	_, err = w.Write(configJson)
+	return err
+}
+
+func unretweetTweets(ctx context.Context) error {
+	return forEachAccount(ctx, func(ctx context.Context, account string) error {
+		twitterApi, err := twitterApiFor(ctx, account)
+		if err == ErrNotConnected {
+			applog.Infof(ctx, "skipping unretweet for %v, not connected", account)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer twitterApi.Close()
+		return unretweetAccountTweets(ctx, twitterApi, account)
+	})
+}
+
+func unretweetAccountTweets(ctx context.Context, twitterApi *anaconda.TwitterApi, account string) error {
 	tweets := []anaconda.Tweet{}
 	vals := url.Values{
-		"screen_name": {myToken.ScreenName},
+		"screen_name": {account},
 		"count": {"200"},
 		"trim_user": {"1"},
 		"exclude_replies": {"1"},
 		"include_rts": {"1"},
 	}
 	lastId := int64(0)
-	before := time.Now().Unix() - (DAYS_BEFORE_UNRETWEET * SECONDS_IN_DAY)
-	log.Infof(ctx, "unretweet tweets before: %v", time.Unix(before, 0))
+	before := time.Now().Unix() - (int64(AppConfig.DaysBeforeUnretweet) * SECONDS_IN_DAY)
+	applog.Infof(ctx, "unretweet tweets before: %v", time.Unix(before, 0))
 
 	for {
 		idStr := fmt.Sprintf("%v", lastId - 1)
 		if idStr == vals.Get("max_id") {
-			log.Warningf(ctx, "same last id: %v", idStr)
+			applog.Warningf(ctx, "same last id: %v", idStr)
 			break
 		}
 		if lastId != 0 {
@@ -533,10 +834,11 @@ func unretweetHanlder(ctx context.Context, w http.ResponseWriter, r *http.Reques
 		}
 		aTweets, err := twitterApi.GetUserTimeline(vals)
 		if err != nil {
+			checkRevoked(ctx, account, err)
 			return fmt.Errorf("Error getting tweets: %v", err)
 		}
 
-		log.Infof(ctx, "Got tweets, %v", len(aTweets))
+		applog.Infof(ctx, "Got tweets, %v", len(aTweets))
 		if len(aTweets) == 0 {
 			break
 		} else {
@@ -553,65 +855,84 @@ func unretweetHanlder(ctx context.Context, w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	log.Infof(ctx, "tweets to unretweet: %v", len(tweets))
+	applog.Infof(ctx, "tweets to unretweet: %v", len(tweets))
 	for _, tweet := range tweets {
 		if _, err := twitterApi.UnRetweet(tweet.Id, true); err != nil {
-			log.Warningf(ctx, "Error unretweeting: %v", err)
+			applog.Warningf(ctx, "Error unretweeting: %v", err)
+			checkRevoked(ctx, account, err)
 		}
 	}
 
-	w.WriteHeader(http.StatusOK)
 	return nil
 }
 
-func updateUserHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	if _, err := fetchAndStoreUser(ctx); err != nil {
-		return fmt.Errorf("Error fetching and storing user: %v", err)
-	}
-	w.WriteHeader(http.StatusOK)
-	return nil
+// cachedUser is a user as kept in the cache
+type cachedUser struct {
+	User User
+	CachedAt int64
 }
 
-func updateTweetsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	if err := updateDatastoreTweets(ctx); err != nil {
-		return fmt.Errorf("Error updating db tweets: %v", err)
-	}
-	w.WriteHeader(http.StatusOK)
-	return nil
+func cacheUser(ctx context.Context, screenName string, user User) {
+	cache.Set(ctx, MEMCACHE_USER_KEY + strings.ToLower(screenName), cachedUser{User: user, CachedAt: time.Now().Unix()})
 }
 
-func fetchTweetsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	if _, err := fetchAndStoreTweets(ctx); err != nil {
-		return fmt.Errorf("Error fetching and storing tweets: %v", err)
+// getCachedUser returns nil if the user isn't cached
+func getCachedUser(ctx context.Context, screenName string) *cachedUser {
+	var cached cachedUser
+	// entries from before CachedAt was kept count as misses
+	if cache.Get(ctx, MEMCACHE_USER_KEY + strings.ToLower(screenName), &cached) != nil || cached.CachedAt == 0 {
+		return nil
 	}
-	w.WriteHeader(http.StatusOK)
-	return nil
+	return &cached
 }
 
-func getUser(ctx context.Context) (*User, error) {
-	var cached *User
-	memcache.JSON.Get(ctx, MEMCACHE_USER_KEY + MyToken.ScreenName, &cached)
+func getUser(ctx context.Context, screenName string) (*User, error) {
+	cached := getCachedUser(ctx, screenName)
 
 	if cached == nil {
 		var user *User
 		var err error
-		user, err = getDataStoreUser(ctx, MyToken.ScreenName)
+		user, err = getDataStoreUser(ctx, screenName)
 		if err != nil || user == nil {
-			return fetchAndStoreUser(ctx)
+			return fetchAndStoreUser(ctx, screenName)
 		}
 		return user, nil
 	}
-	return cached, nil
+	return &cached.User, nil
 }
 
-func fetchAndStoreUser(ctx context.Context) (*User, error) {
-	TwitterApi.HttpClient.Transport = &urlfetch.Transport{Context: ctx}
-	anacondaUser, err := TwitterApi.GetUsersShow(MyToken.ScreenName, url.Values{
+// getTrackedUsers returns the stored user of every tracked account, in the
+// configured order, skipping accounts not fetched yet
+func getTrackedUsers(ctx context.Context) ([]User, error) {
+	stored, err := UserStorage.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	for _, account := range trackedAccounts() {
+		for _, user := range stored {
+			if strings.EqualFold(user.ScreenName, account) {
+				users = append(users, user)
+				break
+			}
+		}
+	}
+	return users, nil
+}
+
+func fetchAndStoreUser(ctx context.Context, screenName string) (*User, error) {
+	twitterApi, err := twitterApiFor(ctx, screenName)
+	if err != nil {
+		return nil, err
+	}
+	defer twitterApi.Close()
+	anacondaUser, err := twitterApi.GetUsersShow(screenName, url.Values{
 		"include_entities": {"1"},
 	})
 
 	if err != nil {
-		log.Errorf(ctx, "Error getting twitter user: %v", err)
+		applog.Errorf(ctx, "Error getting twitter user: %v", err)
+		checkRevoked(ctx, screenName, err)
 		return nil, err
 	}
 
@@ -625,8 +946,20 @@ func fetchAndStoreUser(ctx context.Context) (*User, error) {
 		UploadFileName: "user/" + anacondaUser.IdStr + "/avatar" + ext,
 	}
 
-	if err := fetchAndStoreMediaFile(ctx, media); err != nil {
-		return nil, fmt.Errorf("Error fetching and storing user profile pic: %v", err)
+	archiveMedia(ctx, &media, 0)
+
+	var banner Media
+	if anacondaUser.ProfileBannerURL != "" {
+		// banners have no extension, twitter serves them at a size
+		banner = Media{
+			IdStr: "banner-" + anacondaUser.IdStr,
+			Url: anacondaUser.ProfileBannerURL,
+			ExpandedUrl: anacondaUser.ProfileBannerURL,
+			Type: "text",
+			MediaUrl: anacondaUser.ProfileBannerURL + "/1500x500",
+			UploadFileName: "user/" + anacondaUser.IdStr + "/banner.jpg",
+		}
+		archiveMedia(ctx, &banner, 0)
 	}
 
 	user := &User{
@@ -644,119 +977,321 @@ func fetchAndStoreUser(ctx context.Context) (*User, error) {
 		Verified: anacondaUser.Verified,
 		Link: anacondaUser.URL,
 		Media: media,
+		ProfileBannerUrl: anacondaUser.ProfileBannerURL,
+		Banner: banner,
 	}
 
-	store := &memcache.Item{
-		Key: MEMCACHE_USER_KEY + MyToken.ScreenName,
-		Object: *user,
+	previous, err := UserStorage.GetUser(ctx, user.ScreenName)
+	if err != nil && err != ErrNotFound {
+		applog.Warningf(ctx, "Error getting previous user: %v", err)
 	}
-	memcache.JSON.Set(ctx, store)
+	if err = recordUserSnapshot(ctx, previous, user); err != nil {
+		applog.Errorf(ctx, "Error recording user snapshot: %v", err)
+	}
+
+	cacheUser(ctx, screenName, *user)
 
 	if err = user.Store(ctx); err != nil {
-		log.Errorf(ctx, "failed to store user: %v", err)
+		applog.Errorf(ctx, "failed to store user: %v", err)
 		return nil, err
 	}
 
 	return user, nil
 }
 
-func getSearchTweets(ctx context.Context, page int, search string, order string) ([]MyTweet, error) {
-	var (
-		tweets []MyTweet
-		err error
-	)
+type SearchOptions struct {
+	// screen name of the account searched, empty for every account
+	Owner string
+	Search string
+	// a stored property, optionally prefixed with "-", or "relevance"
+	Order string
+	// legacy offset paging, ignored when Cursor is set
+	Page int
+	// cursor from a previous result's Next or Prev
+	Cursor string
+	Limit int
+	// weight given to faves and retweets when ordering by relevance
+	Popularity float64
+}
 
-	search = RemovePunctuation(strings.TrimSpace(search), false)
-	if len(search) > MIN_SEARCH_LENGTH {
-		terms := getTerms(search)
-
-		if len(terms) > 0 {
-			query := datastore.NewQuery("MyTweet").
-				Filter("Deleted =", false).
-				Order(order).
-				Offset(page * TWEETS_TO_FETCH)
-			tweets = []MyTweet{}
-			_, err = query.GetAll(ctx, &tweets)
-			if err != nil {
-				log.Errorf(ctx, "Error getting best tweets from datastore: %v", err)
-				return nil, err
-			}
+type SearchResult struct {
+	Hits []SearchHit
+	Total int
+	// the query with unknown words corrected, empty if none were found
+	Suggestion string
+	Next string
+	Prev string
+	PageSize int
+}
 
-			tweets = searchTweets(tweets, terms)
+// searchError maps the errors of bad search parameters to a 400
+func searchError(err error, opts SearchOptions) error {
+	if syntaxErr, ok := err.(*SearchSyntaxError); ok {
+		return BadRequest("%v", syntaxErr)
+	} else if err == ErrInvalidSearchOrder {
+		return BadRequest("Invalid order: %v", opts.Order)
+	} else if err == ErrInvalidCursor || err == ErrSearchTooBroad {
+		return BadRequest("%v", err)
+	}
+	return fmt.Errorf("Error searching tweets: %v", err)
+}
 
-			length := len(tweets)
-			if length > 0 {
-				num := page * TWEETS_TO_FETCH
-				if num < length {
-					return tweets[num : min(num + TWEETS_TO_FETCH, length)], nil
-				}
-				return nil, nil
+func getSearchTweets(ctx context.Context, opts SearchOptions) (*SearchResult, error) {
+	order, err := validateSearchOrder(opts.Order)
+	if err != nil {
+		return nil, err
+	}
+
+	search := strings.TrimSpace(opts.Search)
+	node, err := ParseSearch(search)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = AppConfig.TweetsToFetch
+	}
+	result := &SearchResult{Hits: []SearchHit{}, PageSize: opts.Limit}
+	if node == nil {
+		return result, nil
+	}
+
+	match, err := searchIndex(ctx, node)
+	if err != nil {
+		applog.Errorf(ctx, "Error searching index: %v", err)
+		return nil, err
+	}
+
+	result.Suggestion, err = suggestSearch(ctx, search, node, match)
+	if err != nil {
+		applog.Errorf(ctx, "Error finding search suggestion: %v", err)
+		return nil, err
+	}
+
+	var tweets []MyTweet
+	if match.Narrowed {
+		tweets, err = TweetStorage.GetTweets(ctx, match.Ids)
+	} else {
+		tweets, err = TweetStorage.QueryTweets(ctx, TweetQuery{Owner: opts.Owner})
+	}
+	if err != nil {
+		applog.Errorf(ctx, "Error getting search tweets from datastore: %v", err)
+		return nil, err
+	}
+
+	// the index only narrows candidates, confirm with the tweet matcher
+	tweets = searchTweets(tweets, node)
+	if opts.Owner != "" && match.Narrowed {
+		// the index is shared by every account
+		owned := []MyTweet{}
+		for _, tweet := range tweets {
+			if tweet.OwnedBy(opts.Owner) {
+				owned = append(owned, tweet)
 			}
-			return tweets, nil
 		}
+		tweets = owned
 	}
+	result.Total = len(tweets)
 
-	return tweets, nil
+	var scores []float64
+	if order == SEARCH_ORDER_RELEVANCE {
+		stats, err := IndexStorage.GetStats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		scores = rankTweets(tweets, node, match, stats, opts.Popularity)
+	} else {
+		tweets, err = filterAndSortTweets(tweets, TweetQuery{Order: cursorOrder([]string{order})})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	start := opts.Page * opts.Limit
+	if opts.Cursor != "" {
+		cursor, err := ParseTweetCursor(opts.Cursor, []string{order})
+		if err != nil {
+			return nil, err
+		}
+		if cursor.Before {
+			end := sort.Search(len(tweets), func(i int) bool {
+				return compareSearchEdge(tweets, scores, i, cursor, order) >= 0
+			})
+			start = max(end - opts.Limit, 0)
+		} else {
+			start = sort.Search(len(tweets), func(i int) bool {
+				return compareSearchEdge(tweets, scores, i, cursor, order) > 0
+			})
+		}
+	}
+	start = max(start, 0)
+	end := min(len(tweets), start + opts.Limit)
+
+	for i := start; i < end; i++ {
+		hit := newSearchHit(tweets[i], node)
+		if scores != nil {
+			hit.Score = scores[i]
+		}
+		result.Hits = append(result.Hits, hit)
+	}
+	if end < len(tweets) {
+		result.Next = searchCursor(tweets, scores, end - 1, order, false).String()
+	}
+	if start > 0 && start < len(tweets) {
+		result.Prev = searchCursor(tweets, scores, start, order, true).String()
+	}
+	return result, nil
 }
 
-func getLatestTweets(ctx context.Context, page int) ([]MyTweet, error) {
+func searchCursor(tweets []MyTweet, scores []float64, i int, order string, before bool) *TweetCursor {
+	cursor := newTweetCursor(tweets[i], []string{order}, before)
+	if scores != nil {
+		cursor.Score = scores[i]
+	}
+	return cursor
+}
+
+// compareSearchEdge compares result i with a cursor's edge in result order,
+// ranked results go by score and then newest first
+func compareSearchEdge(tweets []MyTweet, scores []float64, i int, cursor *TweetCursor, order string) int {
+	if scores == nil {
+		return compareOrder(tweets[i], cursor.Edge(), cursorOrder([]string{order}))
+	}
+	if scores[i] > cursor.Score {
+		return -1
+	} else if scores[i] < cursor.Score {
+		return 1
+	}
+	return compareInt64(cursor.Id, tweets[i].Id)
+}
+
+// TweetPage is a cursor paged list of tweets, Next and Prev are empty at
+// either end of the list
+type TweetPage struct {
+	Tweets []MyTweet
+	Next string
+	Prev string
+	PageSize int
+}
+
+// tweetOrders are the orders of the /tweets/ lists
+var tweetOrders = map[string][]string{
+	"latest": []string{"-Id"},
+	"best": []string{"-Faves", "-Rts", "-Ratio"},
+}
+
+func getTweetPage(ctx context.Context, owner string, order []string, token string, limit int) (*TweetPage, error) {
+	var cursor *TweetCursor
+	if token != "" {
+		var err error
+		if cursor, err = ParseTweetCursor(token, order); err != nil {
+			return nil, err
+		}
+	}
+
+	// one extra tweet tells whether there is another page this way
+	tweets, err := TweetStorage.QueryTweets(ctx, TweetQuery{
+		Owner: owner,
+		Order: order,
+		Limit: limit + 1,
+		Cursor: cursor,
+	})
+	if err != nil {
+		applog.Errorf(ctx, "Error getting tweet page from datastore: %v", err)
+		return nil, err
+	}
+
+	page := &TweetPage{Tweets: tweets, PageSize: limit}
+	backwards := cursor != nil && cursor.Before
+	more := len(tweets) > limit
+	if more && backwards {
+		page.Tweets = tweets[1:]
+	} else if more {
+		page.Tweets = tweets[:limit]
+	}
+
+	if len(page.Tweets) == 0 {
+		// past the end, only link back the way we came
+		if backwards {
+			page.Next = cursor.Reverse().String()
+		} else if cursor != nil {
+			page.Prev = cursor.Reverse().String()
+		}
+		return page, nil
+	}
+	if more || backwards {
+		page.Next = newTweetCursor(page.Tweets[len(page.Tweets) - 1], order, false).String()
+	}
+	if (more && backwards) || (cursor != nil && backwards == false) {
+		page.Prev = newTweetCursor(page.Tweets[0], order, true).String()
+	}
+	return page, nil
+}
+
+func getLatestTweets(ctx context.Context, owner string, page int) ([]MyTweet, error) {
 	var (
 		tweets []MyTweet
 		err error
 	)
 
-	query := datastore.NewQuery("MyTweet").
-		Filter("Deleted =", false).
-		Order("-Id").
-		Limit(TWEETS_TO_FETCH).
-		Offset(page * TWEETS_TO_FETCH)
-
-	tweets = []MyTweet{}
-	_, err = query.GetAll(ctx, &tweets)
+	tweets, err = TweetStorage.QueryTweets(ctx, TweetQuery{
+		Owner: owner,
+		Order: []string{"-Id"},
+		Limit: AppConfig.TweetsToFetch,
+		Offset: page * AppConfig.TweetsToFetch,
+	})
 	if err != nil {
-		log.Errorf(ctx, "Error getting latest tweets from datastore: %v", err)
+		applog.Errorf(ctx, "Error getting latest tweets from datastore: %v", err)
 		return nil, err
 	}
 
 	return tweets, nil
 }
 
-func getBestTweets(ctx context.Context, page int) ([]MyTweet, error) {
+func getBestTweets(ctx context.Context, owner string, page int) ([]MyTweet, error) {
 	var (
 		tweets []MyTweet
 		err error
 	)
 
-	query := datastore.NewQuery("MyTweet").
-		Filter("Deleted =", false).
-		Order("-Faves").
-		Order("-Rts").
-		Order("-Ratio").
-		Limit(TWEETS_TO_FETCH).
-		Offset(page * TWEETS_TO_FETCH)
-
-	tweets = []MyTweet{}
-	_, err = query.GetAll(ctx, &tweets)
+	tweets, err = TweetStorage.QueryTweets(ctx, TweetQuery{
+		Owner: owner,
+		Order: []string{"-Faves", "-Rts", "-Ratio"},
+		Limit: AppConfig.TweetsToFetch,
+		Offset: page * AppConfig.TweetsToFetch,
+	})
 	if err != nil {
-		log.Errorf(ctx, "Error getting best tweets from datastore: %v", err)
+		applog.Errorf(ctx, "Error getting best tweets from datastore: %v", err)
 		return nil, err
 	}
 
 	return tweets, nil
 }
 
-func fetchAndStoreTweets(ctx context.Context) ([]MyTweet, error) {
+func fetchAndStoreTweets(ctx context.Context, owner string) ([]MyTweet, error) {
 	var tweets []MyTweet
 
-	lastTweet, _ := getLatestTweet(ctx)
+	lastTweet, err := getLatestTweet(ctx, owner)
+	// claim the old tweets rather than fetch them all again
+	if err == ErrNotFound && strings.EqualFold(owner, defaultAccount()) {
+		if err = claimUnownedTweets(ctx); err != nil {
+			return nil, err
+		}
+		lastTweet, _ = getLatestTweet(ctx, owner)
+	}
 	lastTweetID := int64(0)
 	if lastTweet != nil {
 		lastTweetID = lastTweet.Id
 	}
 
-	tweets, err := fetchTweets(ctx, tweets, int64(0), lastTweetID)
+	twitterApi, err := twitterApiFor(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer twitterApi.Close()
+	tweets, err = fetchTweets(ctx, twitterApi, owner, tweets, int64(0), lastTweetID)
 	if err != nil {
-		log.Errorf(ctx, "error fetching tweets: %v", err)
+		applog.Errorf(ctx, "error fetching tweets: %v", err)
+		checkRevoked(ctx, owner, err)
 		return nil, err
 	}
 
@@ -765,48 +1300,100 @@ func fetchAndStoreTweets(ctx context.Context) ([]MyTweet, error) {
 			return nil, err
 		}
 		// invalidate memcache
-		memcache.JSON.SetMulti(ctx, []*memcache.Item{
-			// &memcache.Item{
-			// 	Key: MEMCACHE_TWEETS_KEY + "best",
-			// 	Object: nil,
-			// },
-			&memcache.Item{
-				Key: MEMCACHE_TWEETS_KEY + "latest",
-				Object: nil,
-			},
-		})
+		// cache.Delete(ctx, tweetsCacheKey(MEMCACHE_TWEETS_KEY, owner, "best"))
+		cache.Delete(ctx, tweetsCacheKey(MEMCACHE_TWEETS_KEY, owner, "latest"))
+		cache.Delete(ctx, tweetsCacheKey(MEMCACHE_API_TWEETS_KEY, owner, "latest"))
 	}
 	return tweets, nil
 }
 
-func updateDatastoreTweets(ctx context.Context) (err error) {
-	tweets := []MyTweet{}
-	query := datastore.NewQuery("MyTweet").Order("Updated").Filter("Deleted =", false)
-	_, err = query.GetAll(ctx, &tweets)
-
+// claimUnownedTweets stores the tweets archived before accounts were tracked
+// as the default account's. Datastore can't query for a missing Owner, so
+// this reads every tweet.
+func claimUnownedTweets(ctx context.Context) error {
+	all, err := TweetStorage.QueryTweets(ctx, TweetQuery{IncludeDeleted: true})
 	if err != nil {
-		log.Errorf(ctx, "error getting tweets: %v", err)
+		return fmt.Errorf("Error getting tweets: %v", err)
+	}
+
+	owner := defaultAccount()
+	unowned := []MyTweet{}
+	for _, tweet := range all {
+		if tweet.Owner == "" {
+			tweet.Owner = owner
+			unowned = append(unowned, tweet)
+		}
+	}
+	if len(unowned) == 0 {
+		return nil
+	}
+
+	applog.Infof(ctx, "Claiming tweets for %v: %v", owner, len(unowned))
+	if err = TweetStorage.PutTweets(ctx, unowned); err != nil {
+		return fmt.Errorf("Error storing claimed tweets: %v", err)
+	}
+	clearTweetCaches(ctx, owner)
+	return nil
+}
+
+// clearTweetCaches drops the cached latest and best lists of owner, on the
+// site and in the api
+func clearTweetCaches(ctx context.Context, owner string) {
+	for _, which := range []string{"latest", "best"} {
+		cache.Delete(ctx, tweetsCacheKey(MEMCACHE_TWEETS_KEY, owner, which))
+		cache.Delete(ctx, tweetsCacheKey(MEMCACHE_API_TWEETS_KEY, owner, which))
+	}
+}
+
+func updateDatastoreTweets(ctx context.Context) (err error) {
+	if err = claimUnownedTweets(ctx); err != nil {
 		return err
 	}
 
-	log.Infof(ctx, "Checking tweets: %v", len(tweets))
-	// Iterate over tweets and fetch from Twitter
-	// Update values
-	// Store
-	tweets, err = checkTweets(ctx, tweets)
+	all, err := TweetStorage.QueryTweets(ctx, TweetQuery{
+		Order: []string{"Updated"},
+	})
+
 	if err != nil {
+		applog.Errorf(ctx, "error getting tweets: %v", err)
 		return err
 	}
-	log.Infof(ctx, "Looked up tweets: %v", len(tweets))
 
-	return storeTweets(ctx, tweets)
+	return forEachAccount(ctx, func(ctx context.Context, owner string) error {
+		tweets := []MyTweet{}
+		for _, tweet := range all {
+			if tweet.OwnedBy(owner) {
+				tweets = append(tweets, tweet)
+			}
+		}
+
+		applog.Infof(ctx, "Checking tweets for %v: %v", owner, len(tweets))
+		twitterApi, err := twitterApiFor(ctx, owner)
+		if err != nil {
+			return err
+		}
+		defer twitterApi.Close()
+		// Iterate over tweets and fetch from Twitter
+		// Update values
+		// Store
+		tweets, err = checkTweets(ctx, twitterApi, owner, tweets)
+		if err != nil {
+			return err
+		}
+		applog.Infof(ctx, "Looked up tweets: %v", len(tweets))
+
+		if err = storeTweets(ctx, tweets); err != nil {
+			return err
+		}
+		clearTweetCaches(ctx, owner)
+		return nil
+	})
 }
 
-func checkTweets(ctx context.Context, tweets []MyTweet) ([]MyTweet, error) {
+func checkTweets(ctx context.Context, twitterApi *anaconda.TwitterApi, owner string, tweets []MyTweet) ([]MyTweet, error) {
 	if len(tweets) == 0 {
 		return nil, nil
 	}
-	TwitterApi.HttpClient.Transport = &urlfetch.Transport{Context: ctx}
 
 	out := []MyTweet{}
 	ids := []int64{}
@@ -815,15 +1402,16 @@ func checkTweets(ctx context.Context, tweets []MyTweet) ([]MyTweet, error) {
 		"include_entities": {"1"},
 	}
 
-	toCheck := tweets[: min(MAX_API_LOOKUP_SIZE, len(tweets))]
-	rest := tweets[min(MAX_API_LOOKUP_SIZE, len(tweets)) :]
+	toCheck := tweets[: min(AppConfig.MaxApiLookupSize, len(tweets))]
+	rest := tweets[min(AppConfig.MaxApiLookupSize, len(tweets)) :]
 
 	for _, t := range toCheck {
 		ids = append(ids, t.Id)
 	}
 
-	aTweets, err := TwitterApi.GetTweetsLookupByIds(ids, vals)
+	aTweets, err := twitterApi.GetTweetsLookupByIds(ids, vals)
 	if err != nil {
+		checkRevoked(ctx, owner, err)
 		return nil, err
 	}
 
@@ -841,13 +1429,13 @@ func checkTweets(ctx context.Context, tweets []MyTweet) ([]MyTweet, error) {
 		}
 
 		if found == false {
-			log.Infof(ctx, "Tweet deleted: %v", t.Id)
+			applog.Infof(ctx, "Tweet deleted: %v", t.Id)
 			t.Deleted = true
 		} else {
 			t.Faves = aTweet.FavoriteCount
 			t.Rts = aTweet.RetweetCount
 			t.Ratio = getRatio(aTweet.FavoriteCount, aTweet.RetweetCount)
-			if t.Media == nil || len(t.Media) == 0 {
+			if t.Media == nil || len(t.Media) == 0 || missingVideo(t.Media) {
 				t.Media, err = getMedia(ctx, &aTweet)
 				if err != nil {
 					return nil, err
@@ -865,7 +1453,7 @@ func checkTweets(ctx context.Context, tweets []MyTweet) ([]MyTweet, error) {
 	}
 
 	if len(rest) > 0 {
-		t, e := checkTweets(ctx, rest)
+		t, e := checkTweets(ctx, twitterApi, owner, rest)
 		if e != nil {
 			return nil, e
 		} else {
@@ -876,63 +1464,55 @@ func checkTweets(ctx context.Context, tweets []MyTweet) ([]MyTweet, error) {
 	return out, nil
 }
 
-func getLatestTweet(ctx context.Context) (*MyTweet, error) {
-	var tweets []MyTweet = []MyTweet{}
-	q := datastore.NewQuery("MyTweet").Limit(1).Order("-Id")
-
-	_, err := q.GetAll(ctx, &tweets)
-	if err != nil || len(tweets) == 0 {
-		log.Errorf(ctx, "error getting last stored tweet: %v", err)
+func getLatestTweet(ctx context.Context, owner string) (*MyTweet, error) {
+	tweet, err := TweetStorage.GetLatestTweet(ctx, owner)
+	if err != nil {
+		applog.Errorf(ctx, "error getting last stored tweet: %v", err)
 		return nil, err
 	}
 
-	return &tweets[0], nil
+	return tweet, nil
 }
 
 func storeTweets(ctx context.Context, tweets []MyTweet) error {
-	keys := []*datastore.Key{}
-	for _, tweet := range tweets {
-		keys = append(keys, tweet.GetKey(ctx))
+	ids := make([]int64, len(tweets))
+	for i, tweet := range tweets {
+		ids[i] = tweet.Id
+	}
+	old, err := TweetStorage.GetTweets(ctx, ids)
+	if err != nil {
+		applog.Errorf(ctx, "Error getting stored tweets from db: %v", err)
+		return err
 	}
 
-	length := len(keys)
-	for i := 0; i < length; i += MAX_PUT_SIZE {
-		max := min(i + MAX_PUT_SIZE, length)
-		slicedKeys := keys[i:max]
-		slicedTweets := tweets[i:max]
-		newKeys, err := datastore.PutMulti(ctx, slicedKeys, slicedTweets)
-		if err != nil {
-			log.Errorf(ctx, "Error storing tweets in db: %v", err)
-			return err
-		} else {
-			log.Infof(ctx, "Saved tweets: %v", len(newKeys))
-		}
+	if err = TweetStorage.PutTweets(ctx, tweets); err != nil {
+		applog.Errorf(ctx, "Error storing tweets in db: %v", err)
+		return err
+	}
+
+	if err = indexTweets(ctx, old, tweets); err != nil {
+		applog.Errorf(ctx, "Error updating search index: %v", err)
+		return err
 	}
 	return nil
 }
 
 func getDataStoreUser(ctx context.Context, screenName string) (*User, error) {
-	user := User{ScreenName: screenName}
-	err := datastore.Get(ctx, user.GetKey(ctx), &user)
+	user, err := UserStorage.GetUser(ctx, screenName)
 	if err != nil {
-		log.Errorf(ctx, "Error getting user from datastore: %v", err)
+		applog.Errorf(ctx, "Error getting user from datastore: %v", err)
 		return nil, err
 	}
 
-	store := &memcache.Item{
-		Key: MEMCACHE_USER_KEY + MyToken.ScreenName,
-		Object: user,
-	}
-	memcache.JSON.Set(ctx, store)
+	cacheUser(ctx, screenName, *user)
 
-	return &user, nil
+	return user, nil
 }
 
-func fetchTweets(ctx context.Context, tweets []MyTweet, lastId int64, latestId int64) ([]MyTweet, error) {
-	TwitterApi.HttpClient.Transport = &urlfetch.Transport{Context: ctx}
-	log.Infof(ctx, "Fetching Tweets (lastId): %v, (latestId): %v", lastId, latestId)
+func fetchTweets(ctx context.Context, twitterApi *anaconda.TwitterApi, owner string, tweets []MyTweet, lastId int64, latestId int64) ([]MyTweet, error) {
+	applog.Infof(ctx, "Fetching Tweets for %v (lastId): %v, (latestId): %v", owner, lastId, latestId)
 	vals := url.Values{
-		"screen_name": {MyToken.ScreenName},
+		"screen_name": {owner},
 		"count": {"200"},
 		"trim_user": {"1"},
 		"exclude_replies": {"1"},
@@ -944,7 +1524,7 @@ func fetchTweets(ctx context.Context, tweets []MyTweet, lastId int64, latestId i
 	if latestId > 0 {
 		vals.Add("since_id", fmt.Sprintf("%v", latestId))
 	}
-	aTweets, err := TwitterApi.GetUserTimeline(vals)
+	aTweets, err := twitterApi.GetUserTimeline(vals)
 	if err != nil {
 		return tweets, err
 	}
@@ -954,15 +1534,15 @@ func fetchTweets(ctx context.Context, tweets []MyTweet, lastId int64, latestId i
 		return tweets, nil
 	}
 
-	procTweets, newLastId := processTweets(ctx, aTweets)
+	procTweets, newLastId := processTweets(ctx, owner, aTweets)
 	tweets = append(tweets, procTweets...)
 
-	log.Infof(ctx, "Fetched Tweets: %v; (newLastId): %v", len(tweets), newLastId)
+	applog.Infof(ctx, "Fetched Tweets: %v; (newLastId): %v", len(tweets), newLastId)
 
-	return fetchTweets(ctx, tweets, newLastId, latestId)
+	return fetchTweets(ctx, twitterApi, owner, tweets, newLastId, latestId)
 }
 
-func processTweets(ctx context.Context, tweets []anaconda.Tweet) ([]MyTweet, int64) {
+func processTweets(ctx context.Context, owner string, tweets []anaconda.Tweet) ([]MyTweet, int64) {
 	out := []MyTweet{}
 	lastId := int64(0)
 	for _, tweet := range tweets {
@@ -976,15 +1556,16 @@ func processTweets(ctx context.Context, tweets []anaconda.Tweet) ([]MyTweet, int
 				Faves: tweet.FavoriteCount,
 				Rts: tweet.RetweetCount,
 				Id: tweet.Id,
+				Owner: owner,
 				Created: parseTimestamp(tweet.CreatedAt, SEARCH_TIME_FORMAT).Unix(),
 				Updated: time.Now().Unix(),
 				Text: tweet.FullText,
-				Url: TWITTER_URL + MyToken.ScreenName + "/status/" + tweet.IdStr,
+				Url: TWITTER_URL + owner + "/status/" + tweet.IdStr,
 				Deleted: false,
 			}
 			m, err := getMedia(ctx, &tweet)
 			if err != nil {
-				log.Warningf(ctx, "Error getting media: %v", err)
+				applog.Warningf(ctx, "Error getting media: %v", err)
 			}
 			myTweet.Media = m
 
@@ -996,163 +1577,86 @@ func processTweets(ctx context.Context, tweets []anaconda.Tweet) ([]MyTweet, int
 }
 
 func getMedia(ctx context.Context, tweet *anaconda.Tweet) (media []Media, err error) {
-	if len(tweet.Entities.Media) > 0 {
-		for i, ent := range tweet.Entities.Media {
-			m := Media{
-				Type: ent.Type,
-				IdStr: ent.Id_str,
-				Url: ent.Url,
-				ExpandedUrl: ent.Expanded_url,
-				MediaUrl: ent.Media_url_https,
-			}
-			m.UploadFileName = getMediaFilePath(tweet.IdStr, m, i)
-			//log.Infof(ctx, "Uploading image path: " + m.UploadFileName + ", %+v", m)
-			if err := fetchAndStoreMediaFile(ctx, m); err != nil {
-				return nil, fmt.Errorf("Error fetching and storing media file: %v", err)
-			}
-			media = append(media, m)
+	// extended entities list every photo and carry the video variants
+	entities := tweet.ExtendedEntities.Media
+	if len(entities) == 0 {
+		entities = tweet.Entities.Media
+	}
+	for i, ent := range entities {
+		m := Media{
+			Type: ent.Type,
+			IdStr: ent.Id_str,
+			Url: ent.Url,
+			ExpandedUrl: ent.Expanded_url,
+			MediaUrl: ent.Media_url_https,
+			Width: ent.Sizes.Large.W,
+			Height: ent.Sizes.Large.H,
 		}
+		if variant, ok := bestVideoVariant(ent.VideoInfo); ok {
+			// the still is kept as the poster and the video archived in its place
+			still := getMediaFilePath(tweet.IdStr, m, i)
+			m.PosterFileName = strings.TrimSuffix(still, path.Ext(still)) + "-poster" + path.Ext(still)
+			m.PosterUrl = ent.Media_url_https
+			poster := Media{MediaUrl: m.PosterUrl, UploadFileName: m.PosterFileName}
+			archiveMedia(ctx, &poster, 0)
+
+			m.MediaUrl = variant.Url
+			m.ContentType = variant.ContentType
+			m.Bitrate = variant.Bitrate
+			m.DurationMillis = ent.VideoInfo.DurationMillis
+		}
+		m.UploadFileName = getMediaFilePath(tweet.IdStr, m, i)
+		//applog.Infof(ctx, "Uploading image path: " + m.UploadFileName + ", %+v", m)
+		archiveMedia(ctx, &m, tweet.Id)
+		media = append(media, m)
 	}
 	return media, nil
 }
 
-func getBucket(ctx context.Context) (*storage.BucketHandle, error) {
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("Error getting storage.Client: %v", err)
-	}
-
-	bucketName, err := file.DefaultBucketName(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("Error getting default bucket name: %v", err)
-	}
-
-	return client.Bucket(bucketName), nil
-}
-
-func fetchAndStoreMediaFile(ctx context.Context, media Media) error {
-	bucket, err := getBucket(ctx)
-	if err != nil {
-		return fmt.Errorf("Error getting bucket: %v", err)
-	}
-
-	client := urlfetch.Client(ctx)
-	resp, err := client.Get(media.MediaUrl)
-	if err != nil {
-		return fmt.Errorf("Error fetching media file from twitter: %v", err)
-	}
-
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("Error reading response: %v", err)
+// bestVideoVariant is the highest bitrate mp4 of a video or animated gif,
+// animated gifs have just the one
+func bestVideoVariant(info anaconda.VideoInfo) (anaconda.Variant, bool) {
+	var best anaconda.Variant
+	found := false
+	for _, variant := range info.Variants {
+		if variant.ContentType != "video/mp4" {
+			continue
 		}
-
-		log.Infof(ctx, "Storing media file: " + media.UploadFileName)
-		if err = storeMediaFile(ctx, bucket, media.UploadFileName, bodyBytes); err != nil {
-			log.Errorf(ctx, "Error storing media file: %v", err)
-			// send bad request or something
-			return fmt.Errorf("Error storing media file to cloud storage: %v", err)
+		if found == false || variant.Bitrate > best.Bitrate {
+			best = variant
+			found = true
 		}
-	} else {
-		// send back request or something
-		log.Warningf(ctx, "Status not ok: %v", resp)
-		//return fmt.Errorf("Response status bad: %v", resp)
-
 	}
-	return nil
+	return best, found
 }
 
-func storeMediaFile(ctx context.Context, bucket *storage.BucketHandle, fileName string, content []byte) error {
-	wc := bucket.Object(fileName).NewWriter(ctx)
-	if _, err := wc.Write(content); err != nil {
-		return err
-	}
-
-	if err := wc.Close(); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func getTerms(search string) (terms [][]SearchTerm) {
-	// ORs[] of ANDs[]
-	quoted := []string{}
-	reg, _ := regexp.Compile("\"[^\"]*\"")
-	//TODO: unpaired quotes
-	newStr := reg.ReplaceAllStringFunc(search, func(quote string) string {
-		quote = strings.Trim(quote, "\"")
-		if len(quote) > MIN_SEARCH_LENGTH {
-			quoted = append(quoted, quote)
-			return "$$"
-		}
-		return ""
-	})
-	ors := strings.Split(newStr, " OR ")
-	for _, or := range ors {
-		split := strings.Fields(or)
-		o := []SearchTerm{}
-		for _, term := range split {
-			if term == "$$" {
-				// unshift from quoted slice
-				str := quoted[0]
-				quoted = quoted[1:]
-				reg, _ = regexp.Compile("(^| )" + strings.ToUpper(str) + "( |$)")
-				o = append(o, SearchTerm{
-					Text: str,
-					Upper: strings.ToUpper(str),
-					Quoted: true,
-					RegExp: reg,
-				})
-			} else if len(term) > MIN_SEARCH_LENGTH {
-				term = RemovePunctuation(term, true)
-				o = append(o, SearchTerm{
-					Text: term,
-					Upper: strings.ToUpper(term),
-					Quoted: false,
-					RegExp: nil,
-				})
-			}
-		}
-
-		if len(o) > 0 {
-			terms = append(terms, o)
+// missingVideo tells whether media was archived before videos were, with
+// only the still of a video or animated gif
+func missingVideo(media []Media) bool {
+	for _, m := range media {
+		if (m.Type == "video" || m.Type == "animated_gif") && m.PosterFileName == "" {
+			return true
 		}
 	}
-	return terms
+	return false
 }
 
-func searchTweets(tweets []MyTweet, terms [][]SearchTerm) (ret []MyTweet) {
+func searchTweets(tweets []MyTweet, node SearchNode) (ret []MyTweet) {
 	for _, tweet := range tweets {
-		if tweet.MatchesTerms(terms) {
+		if tweet.Deleted == false && tweet.MatchesSearch(node) {
 			ret = append(ret, tweet)
 		}
 	}
 	return ret
 }
 
-func RemovePunctuation(text string, quotes bool) string {
-	var reg *regexp.Regexp
-	// other replacements?
-	text = strings.Replace(text, "'", "", -1)
-	text = strings.Replace(text, "&", " and ", -1)
-	text = strings.Replace(text, "%", " percent ", -1)
-	if quotes == true {
-		reg, _ = regexp.Compile("[^a-zA-Z0-9#@ ]")
-	} else {
-		reg, _ = regexp.Compile("[^a-zA-Z0-9#@ \"]")
-	}
-
-	text = reg.ReplaceAllString(text, " ")
-	reg, _ = regexp.Compile(" +")
-	return reg.ReplaceAllString(text, " ")
-}
-
 func getMediaFilePath(tweetID string, m Media, i int) string {
 	num := strconv.Itoa(i + 1)
 	ext := path.Ext(m.MediaUrl)
+	// video urls carry a query
+	if u, err := url.Parse(m.MediaUrl); err == nil {
+		ext = path.Ext(u.Path)
+	}
 	return "status/" + tweetID + "/" + m.Type + "/" + num + ext
 }
 
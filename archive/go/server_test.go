@@ -0,0 +1,471 @@
+package tapp
+
+import (
+	"time"
+	"strings"
+	"testing"
+	"net/url"
+	"net/http"
+	"net/http/httptest"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testAdminToken = "test-admin-token"
+
+// newTestRouter serves every route off a temporary Bolt store and media
+// directory, with a fresh cache and a config tracking alice
+func newTestRouter(t *testing.T) *http.ServeMux {
+	t.Helper()
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "tapp.db"))
+	if err != nil {
+		t.Fatalf("Error opening bolt store: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	SetStorage(store, store, store, store, store, store)
+
+	media, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error opening media dir: %v", err)
+	}
+	MediaStorage = media
+
+	sum := sha256.Sum256([]byte(testAdminToken))
+	AppConfig = DefaultConfig()
+	AppConfig.ScreenName = "alice"
+	AppConfig.MediaStore = MEDIA_STORE_LOCAL
+	AppConfig.AdminTokenHashes = []string{hex.EncodeToString(sum[:])}
+	cache = platformCache{memory: &memoryCache{items: map[string][]byte{}}}
+	return NewRouter()
+}
+
+// serve sends a request through mux, headers are given as name, value pairs
+func serve(mux http.Handler, method string, target string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i + 1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i + 1])
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("Error decoding %q: %v", w.Body.String(), err)
+	}
+}
+
+func testTweets() []MyTweet {
+	return []MyTweet{
+		{Id: 1, IdStr: "1", Owner: "alice", Created: 100, Text: "hello world", Faves: 5, Rts: 1, Ratio: 0.2},
+		{Id: 2, IdStr: "2", Owner: "alice", Created: 200, Text: "archiving tweets", Faves: 50, Rts: 10, Ratio: 0.2},
+		{Id: 3, IdStr: "3", Owner: "alice", Created: 300, Text: "hello again", Faves: 1, Rts: 0, Ratio: 0},
+	}
+}
+
+func storeTestTweets(t *testing.T) {
+	t.Helper()
+	if err := storeTweets(httptest.NewRequest("GET", "/", nil).Context(), testTweets()); err != nil {
+		t.Fatalf("Error storing tweets: %v", err)
+	}
+}
+
+func tweetIds(tweets []MyTweet) []int64 {
+	ids := make([]int64, len(tweets))
+	for i, tweet := range tweets {
+		ids[i] = tweet.Id
+	}
+	return ids
+}
+
+func sameIds(a []int64, b ...int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTweetHandler(t *testing.T) {
+	mux := newTestRouter(t)
+	storeTestTweets(t)
+
+	w := serve(mux, "GET", "/tweet?id=2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /tweet?id=2: %v %v", w.Code, w.Body.String())
+	}
+	var tweet MyTweet
+	decodeBody(t, w, &tweet)
+	if tweet.Id != 2 || tweet.Text != "archiving tweets" {
+		t.Errorf("GET /tweet?id=2 = %+v", tweet)
+	}
+
+	for target, status := range map[string]int{
+		"/tweet?id=9": http.StatusNotFound,
+		"/tweet?id=x": http.StatusBadRequest,
+		"/tweet": http.StatusBadRequest,
+	} {
+		if w = serve(mux, "GET", target, "Accept", "application/json"); w.Code != status {
+			t.Errorf("GET %v: %v, want %v", target, w.Code, status)
+		}
+	}
+}
+
+func TestTweetsHandler(t *testing.T) {
+	mux := newTestRouter(t)
+	storeTestTweets(t)
+
+	var tweets []MyTweet
+	w := serve(mux, "GET", "/tweets/latest?page=0")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /tweets/latest: %v %v", w.Code, w.Body.String())
+	}
+	decodeBody(t, w, &tweets)
+	if ids := tweetIds(tweets); sameIds(ids, 3, 2, 1) == false {
+		t.Errorf("latest tweets = %v", ids)
+	}
+
+	// with no paging params at all old clients still get the bare array
+	w = serve(mux, "GET", "/tweets/latest")
+	decodeBody(t, w, &tweets)
+	if ids := tweetIds(tweets); sameIds(ids, 3, 2, 1) == false {
+		t.Errorf("latest tweets without params = %v", ids)
+	}
+
+	w = serve(mux, "GET", "/tweets/best?page=0")
+	decodeBody(t, w, &tweets)
+	if ids := tweetIds(tweets); sameIds(ids, 2, 1, 3) == false {
+		t.Errorf("best tweets = %v", ids)
+	}
+
+	w = serve(mux, "GET", "/tweets/latest?page=1")
+	decodeBody(t, w, &tweets)
+	if len(tweets) != 0 {
+		t.Errorf("latest tweets page 1 = %v", tweetIds(tweets))
+	}
+
+	if w = serve(mux, "GET", "/tweets/worst?page=0", "Accept", "application/json"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /tweets/worst: %v", w.Code)
+	}
+}
+
+func TestTweetPages(t *testing.T) {
+	mux := newTestRouter(t)
+	storeTestTweets(t)
+
+	var page TweetPage
+	w := serve(mux, "GET", "/tweets/latest?limit=2&cursor=")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /tweets/latest?limit=2: %v %v", w.Code, w.Body.String())
+	}
+	decodeBody(t, w, &page)
+	if ids := tweetIds(page.Tweets); sameIds(ids, 3, 2) == false || page.Next == "" {
+		t.Fatalf("first page = %v, next %q", ids, page.Next)
+	}
+
+	w = serve(mux, "GET", "/tweets/latest?limit=2&cursor=" + page.Next)
+	decodeBody(t, w, &page)
+	if ids := tweetIds(page.Tweets); sameIds(ids, 1) == false || page.Next != "" || page.Prev == "" {
+		t.Errorf("second page = %v, next %q, prev %q", ids, page.Next, page.Prev)
+	}
+
+	if w = serve(mux, "GET", "/tweets/latest?cursor=junk", "Accept", "application/json"); w.Code != http.StatusBadRequest {
+		t.Errorf("GET with a bad cursor: %v", w.Code)
+	}
+	if w = serve(mux, "GET", "/tweets/latest?limit=0", "Accept", "application/json"); w.Code != http.StatusBadRequest {
+		t.Errorf("GET with limit=0: %v", w.Code)
+	}
+}
+
+func TestSearchTweetsHandler(t *testing.T) {
+	mux := newTestRouter(t)
+	storeTestTweets(t)
+
+	var tweets []MyTweet
+	w := serve(mux, "GET", "/tweets/search?search=hello&order=-Id&page=0")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /tweets/search: %v %v", w.Code, w.Body.String())
+	}
+	decodeBody(t, w, &tweets)
+	if ids := tweetIds(tweets); sameIds(ids, 3, 1) == false {
+		t.Errorf("search hello = %v", ids)
+	}
+	if total := w.Header().Get("X-Total-Count"); total != "2" {
+		t.Errorf("X-Total-Count = %q", total)
+	}
+
+	// without an order the most faved come first, as before relevance
+	w = serve(mux, "GET", "/tweets/search?search=hello&page=0")
+	decodeBody(t, w, &tweets)
+	if ids := tweetIds(tweets); sameIds(ids, 1, 3) == false {
+		t.Errorf("search hello without an order = %v", ids)
+	}
+
+	w = serve(mux, "GET", "/tweets/search?search=hello+-again&page=0")
+	decodeBody(t, w, &tweets)
+	if ids := tweetIds(tweets); sameIds(ids, 1) == false {
+		t.Errorf("search hello -again = %v", ids)
+	}
+
+	w = serve(mux, "GET", "/tweets/search?search=hello&order=nonsense&page=0", "Accept", "application/json")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GET with a bad order: %v", w.Code)
+	}
+}
+
+func TestUserHandlers(t *testing.T) {
+	mux := newTestRouter(t)
+	ctx := httptest.NewRequest("GET", "/", nil).Context()
+	if err := UserStorage.PutUser(ctx, User{ScreenName: "alice", Id: 7, Name: "Alice"}); err != nil {
+		t.Fatalf("Error storing user: %v", err)
+	}
+
+	var user User
+	w := serve(mux, "GET", "/user")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /user: %v %v", w.Code, w.Body.String())
+	}
+	decodeBody(t, w, &user)
+	if user.ScreenName != "alice" || user.Name != "Alice" {
+		t.Errorf("GET /user = %+v", user)
+	}
+
+	var users []User
+	decodeBody(t, serve(mux, "GET", "/users"), &users)
+	if len(users) != 1 || users[0].Id != 7 {
+		t.Errorf("GET /users = %+v", users)
+	}
+
+	// the user was cached by the first read, cachedAt is when
+	var resp struct {
+		Data User
+		CachedAt *int64
+	}
+	decodeBody(t, serve(mux, "GET", API_PREFIX + "/user"), &resp)
+	if resp.Data.ScreenName != "alice" || resp.CachedAt == nil || time.Now().Unix() - *resp.CachedAt > 60 {
+		t.Errorf("GET %v/user = %+v, cachedAt %v", API_PREFIX, resp.Data, resp.CachedAt)
+	}
+}
+
+func TestApiTweets(t *testing.T) {
+	mux := newTestRouter(t)
+	storeTestTweets(t)
+
+	var resp struct {
+		Data []MyTweet
+		Page *ApiPage
+		HasMore bool
+		Total *int
+	}
+	w := serve(mux, "GET", API_PREFIX + "/tweets/latest?limit=2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %v/tweets/latest: %v %v", API_PREFIX, w.Code, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); strings.HasPrefix(contentType, "application/json") == false {
+		t.Errorf("Content-Type = %q", contentType)
+	}
+	decodeBody(t, w, &resp)
+	if ids := tweetIds(resp.Data); sameIds(ids, 3, 2) == false || resp.HasMore == false {
+		t.Errorf("api latest = %v, more %v", ids, resp.HasMore)
+	}
+	if resp.Total == nil || *resp.Total != 3 {
+		t.Errorf("api latest total = %v", resp.Total)
+	}
+
+	// with several accounts each total counts only that account's tweets
+	AppConfig.Accounts = []string{"alice", "bob"}
+	deleted := testTweets()[0]
+	deleted.Deleted = true
+	tweets := []MyTweet{
+		deleted,
+		{Id: 4, IdStr: "4", Owner: "bob", Created: 400, Text: "bob here"},
+		{Id: 5, IdStr: "5", Created: 50, Text: "from before owners"},
+	}
+	if err := storeTweets(httptest.NewRequest("GET", "/", nil).Context(), tweets); err != nil {
+		t.Fatalf("Error storing tweets: %v", err)
+	}
+	for target, want := range map[string]int{
+		API_PREFIX + "/tweets/best?limit=2": 3,
+		"/bob" + API_PREFIX + "/tweets/best?limit=2": 1,
+	} {
+		resp.Total = nil
+		decodeBody(t, serve(mux, "GET", target), &resp)
+		if resp.Total == nil || *resp.Total != want {
+			t.Errorf("GET %v total = %v, want %v", target, resp.Total, want)
+		}
+	}
+
+	// a delete drops the cached first page and its total
+	resp.Total = nil
+	decodeBody(t, serve(mux, "GET", API_PREFIX + "/tweets/latest"), &resp)
+	if w = serve(mux, "POST", "/admin/delete?id=2", "Authorization", "Bearer " + testAdminToken); w.Code != http.StatusOK {
+		t.Fatalf("POST /admin/delete: %v %v", w.Code, w.Body.String())
+	}
+	resp.Total = nil
+	decodeBody(t, serve(mux, "GET", API_PREFIX + "/tweets/latest"), &resp)
+	if resp.Total == nil || *resp.Total != 2 || sameIds(tweetIds(resp.Data), 5, 3) == false {
+		t.Errorf("api latest after a delete = %v, total %v", tweetIds(resp.Data), resp.Total)
+	}
+}
+
+func TestClaimUnownedTweets(t *testing.T) {
+	newTestRouter(t)
+	ctx := httptest.NewRequest("GET", "/", nil).Context()
+	tweets := testTweets()
+	for i := range tweets {
+		tweets[i].Owner = ""
+	}
+	tweets[0].Deleted = true
+	if err := storeTweets(ctx, tweets); err != nil {
+		t.Fatalf("Error storing tweets: %v", err)
+	}
+
+	if err := Jobs.Run(ctx, "/migrate/owners"); err != nil {
+		t.Fatalf("Error running /migrate/owners: %v", err)
+	}
+	all, err := TweetStorage.QueryTweets(ctx, TweetQuery{IncludeDeleted: true})
+	if err != nil {
+		t.Fatalf("Error getting tweets: %v", err)
+	}
+	for _, tweet := range all {
+		if tweet.Owner != "alice" {
+			t.Errorf("tweet %v owner = %q after the migration", tweet.Id, tweet.Owner)
+		}
+	}
+	if count, err := TweetStorage.CountTweets(ctx, "alice"); err != nil || count != 2 {
+		t.Errorf("alice's tweets after the migration = %v, %v", count, err)
+	}
+}
+
+func TestProtectedRoutes(t *testing.T) {
+	mux := newTestRouter(t)
+
+	for _, target := range []string{"/fetch", "/update/tweets", "/admin/jobs", "/admin/config"} {
+		if w := serve(mux, "GET", target, "Accept", "application/json"); w.Code != http.StatusUnauthorized {
+			t.Errorf("GET %v without credentials: %v", target, w.Code)
+		}
+	}
+
+	w := serve(mux, "GET", "/admin/jobs", "Accept", "text/html")
+	if w.Code != http.StatusFound || strings.HasPrefix(w.Header().Get("Location"), "/admin/login") == false {
+		t.Errorf("GET /admin/jobs from a browser: %v %v", w.Code, w.Header().Get("Location"))
+	}
+
+	w = serve(mux, "GET", "/admin/jobs", "Authorization", "Bearer " + testAdminToken)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /admin/jobs with the admin token: %v %v", w.Code, w.Body.String())
+	}
+	w = serve(mux, "GET", "/admin/jobs", "Authorization", "Bearer wrong", "Accept", "application/json")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /admin/jobs with a wrong token: %v", w.Code)
+	}
+}
+
+func TestAdminSession(t *testing.T) {
+	mux := newTestRouter(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	AppConfig.AdminPasswordHash = string(hash)
+	AppConfig.SessionSecret = "test-session-secret"
+
+	r := httptest.NewRequest("POST", "/admin/login", strings.NewReader(url.Values{"password": {"secret"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	var cookie string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SESSION_COOKIE {
+			cookie = c.Name + "=" + c.Value
+		}
+	}
+	if w.Code != http.StatusSeeOther || cookie == "" {
+		t.Fatalf("POST /admin/login: %v %v", w.Code, w.Header())
+	}
+
+	if w = serve(mux, "GET", "/admin/jobs", "Cookie", cookie); w.Code != http.StatusOK {
+		t.Errorf("GET /admin/jobs with a session: %v %v", w.Code, w.Body.String())
+	}
+	if w = serve(mux, "POST", "/admin/logout", "Cookie", cookie); w.Code != http.StatusSeeOther {
+		t.Errorf("POST /admin/logout: %v", w.Code)
+	}
+	// the signed cookie outlives the logout but the session is gone
+	if w = serve(mux, "GET", "/admin/jobs", "Cookie", cookie, "Accept", "application/json"); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /admin/jobs after logout: %v", w.Code)
+	}
+
+	if err = AppConfig.Validate(); err != nil {
+		t.Fatalf("Error validating config: %v", err)
+	}
+	cfg := *AppConfig
+	cfg.SessionSecret = ""
+	if err = cfg.Validate(); err == nil || strings.Contains(err.Error(), "sessionSecret") == false {
+		t.Errorf("validating a login without a sessionSecret = %v", err)
+	}
+}
+
+func TestMediaHandler(t *testing.T) {
+	mux := newTestRouter(t)
+	ctx := httptest.NewRequest("GET", "/", nil).Context()
+	if err := MediaStorage.Put(ctx, "status/1/photo/1.png", strings.NewReader("png"), "image/png"); err != nil {
+		t.Fatalf("Error storing media: %v", err)
+	}
+
+	w := serve(mux, "GET", "/media?file=status/1/photo/1.png")
+	if w.Code != http.StatusOK || w.Body.String() != "png" || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("GET /media: %v %q %q", w.Code, w.Body.String(), w.Header().Get("Content-Type"))
+	}
+
+	for target, status := range map[string]int{
+		"/media?file=status/1/photo/2.png": http.StatusNotFound,
+		"/media?file=../config.yaml": http.StatusBadRequest,
+		"/media?file=status/1/photo/1.png&size=huge": http.StatusBadRequest,
+		"/media": http.StatusBadRequest,
+	} {
+		if w = serve(mux, "GET", target, "Accept", "application/json"); w.Code != status {
+			t.Errorf("GET %v: %v, want %v", target, w.Code, status)
+		}
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	mux := newTestRouter(t)
+
+	w := serve(mux, "GET", "/no/such/page", "Accept", "application/json")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("GET /no/such/page: %v", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); strings.HasPrefix(contentType, "application/problem+json") == false {
+		t.Errorf("Content-Type = %q", contentType)
+	}
+	var problem struct {
+		Status int
+		Title string
+	}
+	decodeBody(t, w, &problem)
+	if problem.Status != http.StatusNotFound {
+		t.Errorf("problem = %+v", problem)
+	}
+
+	if w = serve(mux, "POST", "/", "Accept", "application/json"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /: %v", w.Code)
+	}
+
+	// browsers get the error page with the same status
+	w = serve(mux, "GET", "/no/such/page", "Accept", "text/html,application/xhtml+xml")
+	if w.Code != http.StatusNotFound || strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") == false || strings.Contains(w.Body.String(), "404 Not Found") == false {
+		t.Errorf("GET /no/such/page from a browser: %v %v %q", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
@@ -0,0 +1,177 @@
+package tapp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"errors"
+	"context"
+)
+
+var (
+	// ErrNotFound is returned by a store when the requested entity does not exist
+	ErrNotFound = errors.New("tapp: entity not found")
+
+	TweetStorage TweetStore = datastoreStore{}
+	UserStorage UserStore = datastoreStore{}
+	TokenStorage TokenStore = datastoreStore{}
+	JobStorage JobStore = datastoreStore{}
+)
+
+// TweetStore persists MyTweet entities
+type TweetStore interface {
+	GetTweet(ctx context.Context, id int64) (*MyTweet, error)
+	// GetTweets returns the stored tweets among ids, skipping unknown ids
+	GetTweets(ctx context.Context, ids []int64) ([]MyTweet, error)
+	// GetLatestTweet returns the owner's tweet with the highest id
+	GetLatestTweet(ctx context.Context, owner string) (*MyTweet, error)
+	QueryTweets(ctx context.Context, query TweetQuery) ([]MyTweet, error)
+	PutTweets(ctx context.Context, tweets []MyTweet) error
+	// CountTweets returns the number of the owner's tweets that are not deleted
+	CountTweets(ctx context.Context, owner string) (int, error)
+}
+
+// UserStore persists the tracked Users and the snapshots of their profiles
+type UserStore interface {
+	GetUser(ctx context.Context, screenName string) (*User, error)
+	ListUsers(ctx context.Context) ([]User, error)
+	PutUser(ctx context.Context, user User) error
+	PutUserSnapshot(ctx context.Context, snapshot UserSnapshot) error
+	// ListUserSnapshots returns the account's snapshots, oldest first
+	ListUserSnapshots(ctx context.Context, account string) ([]UserSnapshot, error)
+}
+
+// TokenStore persists API tokens, keyed by their public id, the twitter
+// access tokens of connected accounts, keyed by screen name, and the logged
+// in admin sessions, keyed by session id
+type TokenStore interface {
+	GetApiToken(ctx context.Context, id string) (*ApiToken, error)
+	ListApiTokens(ctx context.Context) ([]ApiToken, error)
+	PutApiToken(ctx context.Context, token ApiToken) error
+	DeleteApiToken(ctx context.Context, id string) error
+	GetTwitterAuth(ctx context.Context, screenName string) (*TwitterAuth, error)
+	PutTwitterAuth(ctx context.Context, auth TwitterAuth) error
+	GetAdminSession(ctx context.Context, id string) (*AdminSession, error)
+	PutAdminSession(ctx context.Context, session AdminSession) error
+	DeleteAdminSession(ctx context.Context, id string) error
+}
+
+type TweetQuery struct {
+	// screen name of the account, empty for every account
+	Owner string
+	IncludeDeleted bool
+	// property names, prefixed with "-" for descending
+	Order []string
+	Limit int
+	Offset int
+	// only tweets after the cursor in Order (or before it, for a backwards
+	// cursor) are returned, in Order either way
+	Cursor *TweetCursor
+}
+
+// SetStorage swaps the backend used for all tweet, user, index, token,
+// media reference and job lease reads and writes
+func SetStorage(tweets TweetStore, users UserStore, index IndexStore, tokens TokenStore, media MediaRefStore, jobs JobStore) {
+	TweetStorage = tweets
+	UserStorage = users
+	IndexStorage = index
+	TokenStorage = tokens
+	MediaRefStorage = media
+	JobStorage = jobs
+}
+
+// filterAndSortTweets applies a TweetQuery in memory for backends without
+// their own query engine
+func filterAndSortTweets(tweets []MyTweet, query TweetQuery) ([]MyTweet, error) {
+	out := []MyTweet{}
+	for _, tweet := range tweets {
+		if query.Owner != "" && tweet.OwnedBy(query.Owner) == false {
+			continue
+		}
+		if query.IncludeDeleted || tweet.Deleted == false {
+			out = append(out, tweet)
+		}
+	}
+
+	for _, order := range query.Order {
+		if _, err := compareTweets(MyTweet{}, MyTweet{}, order); err != nil {
+			return nil, err
+		}
+	}
+
+	order := query.Order
+	if query.Cursor != nil {
+		// backwards pages are read as forward pages of the reversed order
+		order = cursorOrder(order)
+		if query.Cursor.Before {
+			order = reverseOrder(order)
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return compareOrder(out[i], out[j], order) < 0
+	})
+
+	if query.Cursor != nil {
+		edge := query.Cursor.Edge()
+		start := sort.Search(len(out), func(i int) bool {
+			return compareOrder(out[i], edge, order) > 0
+		})
+		out = out[start:]
+	}
+	if query.Offset > 0 {
+		out = out[min(query.Offset, len(out)):]
+	}
+	if query.Limit > 0 {
+		out = out[:min(query.Limit, len(out))]
+	}
+	if query.Cursor != nil && query.Cursor.Before {
+		reverseTweets(out)
+	}
+	return out, nil
+}
+
+func reverseTweets(tweets []MyTweet) {
+	for i, j := 0, len(tweets) - 1; i < j; i, j = i + 1, j - 1 {
+		tweets[i], tweets[j] = tweets[j], tweets[i]
+	}
+}
+
+// compareTweets orders two tweets by a datastore style order string
+func compareTweets(a MyTweet, b MyTweet, order string) (int, error) {
+	field := strings.TrimPrefix(order, "-")
+	var c int
+	switch field {
+	case "Id":
+		c = compareInt64(a.Id, b.Id)
+	case "Created":
+		c = compareInt64(a.Created, b.Created)
+	case "Updated":
+		c = compareInt64(a.Updated, b.Updated)
+	case "Faves":
+		c = compareInt64(int64(a.Faves), int64(b.Faves))
+	case "Rts":
+		c = compareInt64(int64(a.Rts), int64(b.Rts))
+	case "Ratio":
+		if a.Ratio < b.Ratio {
+			c = -1
+		} else if a.Ratio > b.Ratio {
+			c = 1
+		}
+	default:
+		return 0, fmt.Errorf("Error invalid order property: %q", order)
+	}
+	if strings.HasPrefix(order, "-") {
+		return -c, nil
+	}
+	return c, nil
+}
+
+func compareInt64(a int64, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
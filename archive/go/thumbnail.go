@@ -0,0 +1,119 @@
+package tapp
+
+import (
+	"io"
+	"fmt"
+	"path"
+	"time"
+	"bytes"
+	"image"
+	"strings"
+	"context"
+	"image/jpeg"
+	"crypto/sha256"
+	"encoding/hex"
+	_ "image/gif"
+	_ "image/png"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// thumbnailSize is a derivative generated for stored images, scaled to fit
+// within Edge pixels
+type thumbnailSize struct {
+	Name string
+	Edge int
+}
+
+var thumbnailSizes = []thumbnailSize{
+	{Name: THUMBNAIL_SMALL, Edge: 320},
+	{Name: THUMBNAIL_MEDIUM, Edge: 800},
+}
+
+func validThumbnailSize(name string) bool {
+	for _, size := range thumbnailSizes {
+		if size.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// thumbnailPath is the media path of a derivative, status/1/photo/1.png at
+// small is status/1/photo/1-small.jpg
+func thumbnailPath(filePath string, size string) string {
+	return strings.TrimSuffix(filePath, path.Ext(filePath)) + "-" + size + ".jpg"
+}
+
+// storeThumbnails generates the derivatives of an image smaller than it,
+// storing them content addressed like the media itself. It returns the paths
+// stored by size name, images it can't decode have none.
+func storeThumbnails(ctx context.Context, filePath string, r io.ReadSeeker) (map[string]string, error) {
+	stored := map[string]string{}
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return stored, nil
+	}
+	if config.Width * config.Height > MAX_THUMBNAIL_SOURCE_PIXELS {
+		return stored, fmt.Errorf("Error image too large for thumbnails: %vx%v", config.Width, config.Height)
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return stored, err
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return stored, fmt.Errorf("Error decoding image: %v", err)
+	}
+
+	for _, size := range thumbnailSizes {
+		bounds := src.Bounds()
+		if bounds.Dx() <= size.Edge && bounds.Dy() <= size.Edge {
+			continue
+		}
+		var buf bytes.Buffer
+		if err = jpeg.Encode(&buf, scaleToFit(src, size.Edge), &jpeg.Options{Quality: THUMBNAIL_QUALITY}); err != nil {
+			return stored, fmt.Errorf("Error encoding thumbnail: %v", err)
+		}
+
+		sum := sha256.Sum256(buf.Bytes())
+		hash := hex.EncodeToString(sum[:])
+		name := mediaBlobName(hash)
+		if _, err = MediaStorage.Stat(ctx, name); err == ErrBlobNotFound {
+			if err = MediaStorage.Put(ctx, name, bytes.NewReader(buf.Bytes()), "image/jpeg"); err != nil {
+				return stored, fmt.Errorf("Error storing thumbnail: %v", err)
+			}
+		} else if err != nil {
+			return stored, fmt.Errorf("Error checking thumbnail: %v", err)
+		}
+
+		thumbPath := thumbnailPath(filePath, size.Name)
+		err = MediaRefStorage.PutMediaRef(ctx, MediaRef{
+			Path: thumbPath,
+			Hash: hash,
+			Size: int64(buf.Len()),
+			ContentType: "image/jpeg",
+			Updated: time.Now().Unix(),
+		})
+		if err != nil {
+			return stored, err
+		}
+		stored[size.Name] = thumbPath
+	}
+	return stored, nil
+}
+
+// scaleToFit scales src down to fit within edge pixels, keeping its aspect
+// ratio, onto white since jpegs have no transparency
+func scaleToFit(src image.Image, edge int) image.Image {
+	bounds := src.Bounds()
+	w, h := edge, edge
+	if bounds.Dx() > bounds.Dy() {
+		h = max(1, bounds.Dy() * edge / bounds.Dx())
+	} else {
+		w = max(1, bounds.Dx() * edge / bounds.Dy())
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
@@ -0,0 +1,212 @@
+package tapp
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// TextToken is a normalized search token and the byte range of Text it came
+// from
+type TextToken struct {
+	Token string
+	Start int
+	End int
+}
+
+// tokenizeSpans splits text into normalized search tokens, keeping the byte
+// offsets of each token in text. Both tweets and search queries go through
+// here so they always agree:
+//
+//	words are NFKC normalized, case folded and stripped of diacritics
+//	Han and kana runs become overlapping bigrams, as they have no spaces,
+//	and each Han character is also a token so one character searches match
+//	each emoji (with its modifiers and joiners) is a token of its own
+//	apostrophes are dropped without splitting a word
+//	# and @ start a word only after a space or punctuation, so me@example.com
+//	is no mention, and are dropped before Han or kana
+func tokenizeSpans(text string) []TextToken {
+	tokens := []TextToken{}
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		after, _ := utf8.DecodeRuneInString(text[i + size:])
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		switch {
+		case isCJKRune(r):
+			end := i
+			for end < len(text) {
+				next, n := utf8.DecodeRuneInString(text[end:])
+				if isCJKRune(next) == false {
+					break
+				}
+				end += n
+			}
+			tokens = append(tokens, cjkTokens(text, i, end)...)
+			i = end
+		case isEmojiRune(r):
+			end := emojiEnd(text, i)
+			tokens = append(tokens, TextToken{Token: normalizeEmoji(text[i:end]), Start: i, End: end})
+			i = end
+		case isWordRune(r) || (isTagRune(r) && isWordRune(after) && (i == 0 || isWordRune(before) == false)):
+			end := i + size
+			for end < len(text) {
+				next, n := utf8.DecodeRuneInString(text[end:])
+				if isWordRune(next) == false && isApostrophe(next) == false {
+					break
+				}
+				end += n
+			}
+			if word := normalizeWord(text[i:end]); word != "" {
+				tokens = append(tokens, TextToken{Token: word, Start: i, End: end})
+			}
+			i = end
+		default:
+			i += size
+		}
+	}
+	return tokens
+}
+
+func tokenize(text string) []string {
+	spans := tokenizeSpans(text)
+	tokens := make([]string, len(spans))
+	for i, span := range spans {
+		tokens[i] = span.Token
+	}
+	return tokens
+}
+
+// isWordRune tells whether r belongs in a space separated word, Han and kana
+// end one so iPhone買った is a word and bigrams
+func isWordRune(r rune) bool {
+	return isCJKRune(r) == false && (unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r))
+}
+
+func isTagRune(r rune) bool {
+	return r == '#' || r == '@'
+}
+
+func isApostrophe(r rune) bool {
+	return r == '\'' || r == '’'
+}
+
+func isCJKRune(r rune) bool {
+	// ー and 々 are in the common script but only appear inside Japanese words
+	return r == 'ー' || r == '々' || unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+func isEmojiRune(r rune) bool {
+	return (r >= 0x1F000 && r <= 0x1FAFF) ||
+		(r >= 0x2600 && r <= 0x27BF) ||
+		(r >= 0x2B00 && r <= 0x2BFF) ||
+		(r >= 0x2300 && r <= 0x23FF)
+}
+
+// normalizeWord applies NFKC, case folding and diacritic stripping
+func normalizeWord(word string) string {
+	word = strings.Map(func(r rune) rune {
+		if isApostrophe(r) {
+			return -1
+		}
+		return r
+	}, word)
+	word = cases.Fold().String(norm.NFKC.String(word))
+	return stripDiacritics(word)
+}
+
+// stripDiacritics removes combining marks from Latin, Greek and Cyrillic
+// letters only, as marks in other scripts (e.g. Devanagari vowel signs) are
+// part of the spelling
+func stripDiacritics(word string) string {
+	var (
+		b strings.Builder
+		strip bool
+	)
+	for _, r := range norm.NFD.String(word) {
+		if unicode.Is(unicode.Mn, r) {
+			if strip == false {
+				b.WriteRune(r)
+			}
+			continue
+		}
+		strip = unicode.In(r, unicode.Latin, unicode.Greek, unicode.Cyrillic)
+		b.WriteRune(r)
+	}
+	return norm.NFC.String(b.String())
+}
+
+// cjkTokens splits a Han or kana run into overlapping bigrams with a unigram
+// for each Han character, all in order of position so the tokens of a
+// shorter run are always next to each other in those of a run holding it
+func cjkTokens(text string, start int, end int) []TextToken {
+	offsets := []int{}
+	for i := start; i < end; {
+		_, n := utf8.DecodeRuneInString(text[i:])
+		offsets = append(offsets, i)
+		i += n
+	}
+	offsets = append(offsets, end)
+
+	tokens := []TextToken{}
+	for i := 0; i + 1 < len(offsets); i++ {
+		r, _ := utf8.DecodeRuneInString(text[offsets[i]:])
+		if len(offsets) == 2 || unicode.Is(unicode.Han, r) {
+			tokens = append(tokens, TextToken{
+				Token: norm.NFKC.String(text[offsets[i]:offsets[i + 1]]),
+				Start: offsets[i],
+				End: offsets[i + 1],
+			})
+		}
+		if i + 2 < len(offsets) {
+			tokens = append(tokens, TextToken{
+				Token: norm.NFKC.String(text[offsets[i]:offsets[i + 2]]),
+				Start: offsets[i],
+				End: offsets[i + 2],
+			})
+		}
+	}
+	return tokens
+}
+
+// emojiEnd finds the end of the emoji starting at start, including skin
+// tones, variation selectors, keycaps, flag pairs and zero width joined
+// sequences
+func emojiEnd(text string, start int) int {
+	first, end := utf8.DecodeRuneInString(text[start:])
+	end += start
+	if first >= 0x1F1E6 && first <= 0x1F1FF {
+		if next, n := utf8.DecodeRuneInString(text[end:]); next >= 0x1F1E6 && next <= 0x1F1FF {
+			return end + n
+		}
+		return end
+	}
+	for end < len(text) {
+		next, n := utf8.DecodeRuneInString(text[end:])
+		switch {
+		case next == 0xFE0F || next == 0xFE0E || next == 0x20E3 || (next >= 0x1F3FB && next <= 0x1F3FF):
+			end += n
+		case next == 0x200D:
+			joined, m := utf8.DecodeRuneInString(text[end + n:])
+			if isEmojiRune(joined) == false {
+				return end
+			}
+			end += n + m
+		default:
+			return end
+		}
+	}
+	return end
+}
+
+// normalizeEmoji drops variation selectors so text and emoji presentations
+// of the same symbol match
+func normalizeEmoji(emoji string) string {
+	return strings.Map(func(r rune) rune {
+		if r == 0xFE0F || r == 0xFE0E {
+			return -1
+		}
+		return r
+	}, emoji)
+}
@@ -0,0 +1,55 @@
+package tapp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"net/url"
+)
+
+func TestTokenize(t *testing.T) {
+	for text, want := range map[string]string{
+		"Hello, World!": "hello world",
+		"Café don't": "cafe dont",
+		"iPhone買った": "iphone 買 買っ った",
+		"買ったiPhone": "買 買っ った iphone",
+		"#日本語": "日 日本 本 本語 語",
+		"#tapp @vince": "#tapp @vince",
+		"a#b c@d": "a b c d",
+		"me@example.com @vince": "me example com @vince",
+		"# @ ##x": "#x",
+		"東京2020": "東 東京 京 2020",
+	} {
+		if got := strings.Join(tokenize(text), " "); got != want {
+			t.Errorf("tokenize(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestSearchMixedScripts(t *testing.T) {
+	mux := newTestRouter(t)
+	ctx := context.Background()
+	tweets := []MyTweet{
+		{Id: 1, IdStr: "1", Owner: "alice", Text: "iPhone買った"},
+		{Id: 2, IdStr: "2", Owner: "alice", Text: "#日本語 のテスト"},
+		{Id: 3, IdStr: "3", Owner: "alice", Text: "うちの猫たち"},
+	}
+	if err := storeTweets(ctx, tweets); err != nil {
+		t.Fatalf("Error storing tweets: %v", err)
+	}
+
+	for search, want := range map[string]int64{
+		"買った": 1,
+		"iphone": 1,
+		"日本語": 2,
+		"#日本語": 2,
+		"猫": 3,
+		"本": 2,
+	} {
+		var found []MyTweet
+		decodeBody(t, serve(mux, "GET", "/tweets/search?page=0&search=" + url.QueryEscape(search)), &found)
+		if ids := tweetIds(found); sameIds(ids, want) == false {
+			t.Errorf("search %q = %v, want [%v]", search, ids, want)
+		}
+	}
+}
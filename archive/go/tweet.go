@@ -1,14 +1,16 @@
 package tapp
 
 import (
-	"strings"
 	"context"
+	"strings"
 	// "google.golang.org/appengine/log"
 	"google.golang.org/appengine/datastore"
 )
 
 type MyTweet struct {
 	Id int64
+	// screen name of the tracked account that posted it
+	Owner string
 	IdStr string
 	ReplyTo int64
 	Created int64
@@ -28,26 +30,15 @@ func (tweet MyTweet) GetKey(ctx context.Context) *datastore.Key {
 	return datastore.NewKey(ctx, "MyTweet", "", tweet.Id, nil)
 }
 
-func (tweet MyTweet) MatchesTerms(terms [][]SearchTerm) bool {
-	text := strings.ToUpper(RemovePunctuation(tweet.Text, true))
-	for _, or := range terms {
-		match := true
-		for _, term := range or {
-			if term.Quoted == true && term.RegExp != nil {
-				if term.RegExp.MatchString(text) == false {
-					match = false
-					break
-				}
-			} else {
-				if strings.Contains(text, term.Upper) == false {
-					match = false
-					break
-				}
-			}
-		}
-		if match == true {
-			return true
-		}
+// OwnedBy tells whether the tweet belongs to an account, tweets archived
+// before accounts were tracked belong to the default account
+func (tweet MyTweet) OwnedBy(screenName string) bool {
+	if tweet.Owner == "" {
+		return strings.EqualFold(screenName, defaultAccount())
 	}
-	return false
+	return strings.EqualFold(tweet.Owner, screenName)
+}
+
+func (tweet MyTweet) MatchesSearch(node SearchNode) bool {
+	return node.Matches(tweet, tokenize(tweet.Text))
 }
@@ -0,0 +1,243 @@
+package tapp
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"strings"
+	"context"
+	"net/http"
+	"encoding/json"
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/garyburd/go-oauth/oauth"
+	"google.golang.org/appengine"
+)
+
+var (
+	ErrNotConnected = errors.New("tapp: account not connected, authorize it at /admin/connect")
+	ErrAuthRevoked = errors.New("tapp: twitter access revoked, re-authorize at /admin/connect")
+)
+
+// TwitterAuth is the access token an account granted through /admin/connect,
+// the token and secret are sealed with the encryption key
+type TwitterAuth struct {
+	ScreenName string
+	UserId string
+	Token []byte `datastore:",noindex"`
+	Secret []byte `datastore:",noindex"`
+	Connected int64
+	// set once twitter refuses the token, until the account is re-authorized
+	Revoked bool
+}
+
+// pendingConnect is a request token waiting for its callback
+type pendingConnect struct {
+	Account string
+	Secret []byte
+	Created int64
+}
+
+// twitterAuthSecret names the token or secret of an account's TwitterAuth
+// when sealing it
+func twitterAuthSecret(account string, part string) string {
+	return "twitterAuth." + strings.ToLower(account) + "." + part
+}
+
+func oauthRequestSecret(token string) string {
+	return "oauthRequest." + token
+}
+
+// connectionStatus is an account's TwitterAuth as listed to admins
+type connectionStatus struct {
+	Account string
+	Connected bool
+	ConnectedAt int64
+	Revoked bool
+}
+
+// connectHandler lists the accounts' connections on GET, and on POST starts
+// the OAuth 1.0a flow for ?account=, sending the admin to twitter
+func connectHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		return listConnections(ctx, w)
+	}
+	if r.Method != "POST" {
+		return MethodNotAllowed(r.Method, "GET", "POST")
+	}
+
+	account, err := requestAccount(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	callback, err := callbackUrl(ctx)
+	if err != nil {
+		return err
+	}
+	api := anaconda.NewTwitterApi("", "")
+	defer api.Close()
+	api.HttpClient.Transport = transport(ctx)
+	authUrl, tempCred, err := api.AuthorizationURL(callback)
+	if err != nil {
+		return Upstream(err, "Error getting request token")
+	}
+
+	secret, err := sealSecret(oauthRequestSecret(tempCred.Token), tempCred.Secret)
+	if err != nil {
+		return fmt.Errorf("Error sealing request token: %v", err)
+	}
+	err = cache.Set(ctx, MEMCACHE_OAUTH_KEY + tempCred.Token, pendingConnect{
+		Account: account,
+		Secret: secret,
+		Created: time.Now().Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("Error caching request token: %v", err)
+	}
+
+	applog.Infof(ctx, "connecting account %v", account)
+	http.Redirect(w, r, authUrl, http.StatusSeeOther)
+	return nil
+}
+
+func listConnections(ctx context.Context, w http.ResponseWriter) error {
+	statuses := []connectionStatus{}
+	for _, account := range trackedAccounts() {
+		status := connectionStatus{Account: account}
+		auth, err := TokenStorage.GetTwitterAuth(ctx, account)
+		if err == nil {
+			status.Connected = true
+			status.ConnectedAt = auth.Connected
+			status.Revoked = auth.Revoked
+		} else if err != ErrNotFound {
+			return fmt.Errorf("Error getting twitter auth: %v", err)
+		}
+		statuses = append(statuses, status)
+	}
+
+	statusJson, err := json.Marshal(statuses)
+	if err != nil {
+		return fmt.Errorf("Error marshaling json for connections: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, err = w.Write(statusJson)
+	return err
+}
+
+// connectCallbackHandler is where twitter sends the admin back, it trades the
+// verified request token for the account's access token
+func connectCallbackHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	params := r.URL.Query()
+	if denied := params.Get("denied"); denied != "" {
+		cache.Delete(ctx, MEMCACHE_OAUTH_KEY + denied)
+		return BadRequest("Authorization was denied on twitter")
+	}
+
+	token := params.Get("oauth_token")
+	var pending pendingConnect
+	if token == "" || cache.Get(ctx, MEMCACHE_OAUTH_KEY + token, &pending) != nil {
+		return BadRequest("Unknown or expired request token, start again at /admin/connect")
+	}
+	// request tokens are single use
+	cache.Delete(ctx, MEMCACHE_OAUTH_KEY + token)
+	if time.Since(time.Unix(pending.Created, 0)) > OAUTH_REQUEST_LENGTH {
+		return BadRequest("Unknown or expired request token, start again at /admin/connect")
+	}
+
+	secret, err := openSecret(oauthRequestSecret(token), pending.Secret)
+	if err != nil {
+		return err
+	}
+	api := anaconda.NewTwitterApi("", "")
+	defer api.Close()
+	api.HttpClient.Transport = transport(ctx)
+	creds, vals, err := api.GetCredentials(&oauth.Credentials{Token: token, Secret: secret}, params.Get("oauth_verifier"))
+	if err != nil {
+		return Upstream(err, "Error getting access token")
+	}
+
+	screenName := vals.Get("screen_name")
+	if strings.EqualFold(screenName, pending.Account) == false {
+		return BadRequest("Signed in to twitter as @%v, expected @%v", screenName, pending.Account)
+	}
+
+	auth := TwitterAuth{
+		ScreenName: pending.Account,
+		UserId: vals.Get("user_id"),
+		Connected: time.Now().Unix(),
+	}
+	if auth.Token, err = sealSecret(twitterAuthSecret(auth.ScreenName, "token"), creds.Token); err != nil {
+		return fmt.Errorf("Error sealing access token: %v", err)
+	}
+	if auth.Secret, err = sealSecret(twitterAuthSecret(auth.ScreenName, "secret"), creds.Secret); err != nil {
+		return fmt.Errorf("Error sealing access token: %v", err)
+	}
+	if err = TokenStorage.PutTwitterAuth(ctx, auth); err != nil {
+		return fmt.Errorf("Error storing twitter auth: %v", err)
+	}
+
+	applog.Infof(ctx, "connected account %v", auth.ScreenName)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	return nil
+}
+
+// callbackUrl is where twitter sends the admin back to, built from the
+// publicUrl setting rather than the request's Host and forwarded headers
+func callbackUrl(ctx context.Context) (string, error) {
+	base := AppConfig.PublicUrl
+	if base == "" && appengine.IsAppEngine() {
+		base = "https://" + appengine.DefaultVersionHostname(ctx)
+	}
+	if base == "" {
+		return "", &HttpError{Status: http.StatusServiceUnavailable, Msg: "Connecting accounts needs the publicUrl setting"}
+	}
+	return strings.TrimSuffix(base, "/") + "/admin/connect/callback", nil
+}
+
+// twitterApiFor returns an api client acting as the account, with the token
+// from /admin/connect or, for the screenName account, the accessToken
+// setting. Each client runs a goroutine until the caller closes it
+func twitterApiFor(ctx context.Context, account string) (*anaconda.TwitterApi, error) {
+	var api *anaconda.TwitterApi
+	auth, err := TokenStorage.GetTwitterAuth(ctx, account)
+	if err == ErrNotFound {
+		if strings.EqualFold(account, AppConfig.ScreenName) == false || AppConfig.AccessToken == "" {
+			return nil, ErrNotConnected
+		}
+		api = anaconda.NewTwitterApi(AppConfig.AccessToken, AppConfig.AccessTokenSecret)
+	} else if err != nil {
+		return nil, fmt.Errorf("Error getting twitter auth: %v", err)
+	} else if auth.Revoked {
+		return nil, ErrAuthRevoked
+	} else {
+		token, err := openSecret(twitterAuthSecret(account, "token"), auth.Token)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := openSecret(twitterAuthSecret(account, "secret"), auth.Secret)
+		if err != nil {
+			return nil, err
+		}
+		api = anaconda.NewTwitterApi(token, secret)
+	}
+	api.HttpClient.Transport = transport(ctx)
+	return api, nil
+}
+
+// checkRevoked marks the account's token revoked when twitter answered 401,
+// so jobs stop using it until it's re-authorized
+func checkRevoked(ctx context.Context, account string, err error) {
+	apiErr, ok := err.(*anaconda.ApiError)
+	if ok == false || apiErr.StatusCode != http.StatusUnauthorized {
+		return
+	}
+	auth, err := TokenStorage.GetTwitterAuth(ctx, account)
+	if err != nil {
+		return
+	}
+	applog.Warningf(ctx, "twitter refused the token of %v, marking it revoked", account)
+	auth.Revoked = true
+	if err = TokenStorage.PutTwitterAuth(ctx, *auth); err != nil {
+		applog.Errorf(ctx, "Error storing twitter auth: %v", err)
+	}
+}
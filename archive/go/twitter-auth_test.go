@@ -0,0 +1,38 @@
+package tapp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCallbackUrl(t *testing.T) {
+	newTestRouter(t)
+	ctx := context.Background()
+	if _, err := callbackUrl(ctx); err == nil {
+		t.Errorf("callback without publicUrl = nil error")
+	}
+	AppConfig.PublicUrl = "https://tapp.example.com/"
+	if callback, err := callbackUrl(ctx); err != nil || callback != "https://tapp.example.com/admin/connect/callback" {
+		t.Errorf("callback = %q, %v", callback, err)
+	}
+}
+
+func TestTwitterApiFor(t *testing.T) {
+	newTestRouter(t)
+	ctx := context.Background()
+	AppConfig.Accounts = []string{"alice", "bob"}
+	AppConfig.AccessToken, AppConfig.AccessTokenSecret = "token", "secret"
+
+	// per account jobs use the account's own client, never a shared one
+	if _, err := fetchAndStoreUser(ctx, "bob"); err != ErrNotConnected {
+		t.Errorf("fetching an unconnected account = %v, want ErrNotConnected", err)
+	}
+	if _, err := fetchAndStoreTweets(ctx, "bob"); err != ErrNotConnected {
+		t.Errorf("fetching an unconnected account's tweets = %v, want ErrNotConnected", err)
+	}
+	api, err := twitterApiFor(ctx, "Alice")
+	if err != nil || api.Credentials.Token != "token" {
+		t.Fatalf("client of the screenName account = %v", err)
+	}
+	api.Close()
+}
@@ -0,0 +1,144 @@
+package tapp
+
+import (
+	"fmt"
+	"path"
+	"time"
+	"strconv"
+	"strings"
+	"context"
+	"net/http"
+	"encoding/json"
+)
+
+// UserSnapshot is a tracked user's profile as fetched, kept whenever it or
+// the counts change. Avatars and banners are kept at their own paths so the
+// old ones are still served once they're replaced.
+type UserSnapshot struct {
+	// lowercase screen name
+	Account string
+	Taken int64
+	ScreenName string
+	Name string
+	Description string `datastore:",noindex"`
+	Location string
+	Link string
+	Verified bool
+	Followers int
+	Following int
+	TweetCount int64
+	AvatarFileName string
+	BannerFileName string
+	// profile fields that differ from the snapshot before, empty for the first
+	// and when only the counts changed
+	Changed []string
+}
+
+// recordUserSnapshot keeps user's profile if it differs from previous, nil
+// the first time the user is fetched
+func recordUserSnapshot(ctx context.Context, previous *User, user *User) error {
+	changed := profileChanges(previous, user)
+	if previous != nil && len(changed) == 0 &&
+		previous.Followers == user.Followers &&
+		previous.Following == user.Following &&
+		previous.TweetCount == user.TweetCount {
+		return nil
+	}
+
+	snapshot := UserSnapshot{
+		Account: strings.ToLower(user.ScreenName),
+		Taken: user.Updated,
+		ScreenName: user.ScreenName,
+		Name: user.Name,
+		Description: user.Description,
+		Location: user.Location,
+		Link: user.Link,
+		Verified: user.Verified,
+		Followers: user.Followers,
+		Following: user.Following,
+		TweetCount: user.TweetCount,
+		Changed: changed,
+	}
+	var err error
+	if snapshot.AvatarFileName, err = keepProfileImage(ctx, user.Id, "avatar", user.Media); err != nil {
+		return err
+	}
+	if snapshot.BannerFileName, err = keepProfileImage(ctx, user.Id, "banner", user.Banner); err != nil {
+		return err
+	}
+	if len(changed) > 0 {
+		applog.Infof(ctx, "profile of %v changed: %v", user.ScreenName, strings.Join(changed, ", "))
+	}
+	return UserStorage.PutUserSnapshot(ctx, snapshot)
+}
+
+// keepProfileImage points a path named after the image's hash at its blob,
+// the avatar's own path moves on to the next one
+func keepProfileImage(ctx context.Context, userId int64, kind string, m Media) (string, error) {
+	if m.Hash == "" {
+		return "", nil
+	}
+	filePath := "user/" + strconv.FormatInt(userId, 10) + "/history/" + kind + "-" + m.Hash[:16] + path.Ext(m.UploadFileName)
+	err := MediaRefStorage.PutMediaRef(ctx, MediaRef{
+		Path: filePath,
+		Hash: m.Hash,
+		Size: m.Size,
+		ContentType: m.ContentType,
+		Updated: time.Now().Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error keeping %v: %v", kind, err)
+	}
+	return filePath, nil
+}
+
+// profileChanges lists the profile fields of user that differ from previous
+func profileChanges(previous *User, user *User) []string {
+	changed := []string{}
+	if previous == nil {
+		return changed
+	}
+	check := func(field string, differs bool) {
+		if differs {
+			changed = append(changed, field)
+		}
+	}
+	check("screenName", previous.ScreenName != user.ScreenName)
+	check("name", previous.Name != user.Name)
+	check("description", previous.Description != user.Description)
+	check("location", previous.Location != user.Location)
+	check("link", previous.Link != user.Link)
+	check("verified", previous.Verified != user.Verified)
+	check("avatar", imageChanged(previous.Media, user.Media))
+	check("banner", imageChanged(previous.Banner, user.Banner))
+	return changed
+}
+
+// imageChanged compares by content when both were downloaded, twitter
+// sometimes serves the same image at a new url
+func imageChanged(before Media, after Media) bool {
+	if before.Hash != "" && after.Hash != "" {
+		return before.Hash != after.Hash
+	}
+	return before.MediaUrl != after.MediaUrl
+}
+
+// userHistoryHandler lists the ?account='s profile snapshots, oldest first
+func userHistoryHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	account, err := requestAccount(ctx, r)
+	if err != nil {
+		return err
+	}
+	snapshots, err := UserStorage.ListUserSnapshots(ctx, account)
+	if err != nil {
+		return fmt.Errorf("Error getting user snapshots: %v", err)
+	}
+
+	snapshotsJson, err := json.Marshal(snapshots)
+	if err != nil {
+		return fmt.Errorf("Error marshaling json for user snapshots: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, err = w.Write(snapshotsJson)
+	return err
+}
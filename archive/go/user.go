@@ -2,7 +2,6 @@ package tapp
 
 import (
 	"context"
-	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/datastore"
 )
 
@@ -21,6 +20,8 @@ type User struct {
 	Link string
 	Updated int64
 	Media Media
+	ProfileBannerUrl string
+	Banner Media
 }
 
 func (user User) GetKey(ctx context.Context) *datastore.Key {
@@ -28,12 +29,9 @@ func (user User) GetKey(ctx context.Context) *datastore.Key {
 }
 
 func (user User) Store(ctx context.Context) error {
-	newKey, err := datastore.Put(ctx, user.GetKey(ctx), &user)
-	if err != nil {
-		log.Errorf(ctx, "Error storing user in db: %v", err)
+	if err := UserStorage.PutUser(ctx, user); err != nil {
+		applog.Errorf(ctx, "Error storing user in db: %v", err)
 		return err
-	} else {
-		log.Infof(ctx, "Stored user: %v", newKey)
 	}
 	return nil
 }
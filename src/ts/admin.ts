@@ -1,3 +1,9 @@
+// the admin session's CSRF token, sent back on every change
+function csrfToken(): string {
+  const match = document.cookie.match(/(?:^|; )tapp_csrf=([^;]*)/);
+  return match ? decodeURIComponent(match[1]) : "";
+}
+
 class Upload {
   private el: HTMLElement | null;
   private input: HTMLInputElement | null;
@@ -36,7 +42,8 @@ class Upload {
       method: "POST",
       credentials: 'include',
       headers: new Headers({
-        'Content-Type': ''
+        'Content-Type': '',
+        'X-CSRF-Token': csrfToken()
       }),
       body: file
     }).then(resp => {
@@ -59,8 +66,11 @@ class Deleter {
   public click(): void {
     const el = document.getElementById("delete-tweet-id") as HTMLInputElement;
     fetch("/admin/delete?id=" + el!.value, {
-      method: "GET",
+      method: "POST",
       credentials: "include",
+      headers: new Headers({
+        'X-CSRF-Token': csrfToken()
+      }),
     }).then(() => {
       el!.value = "";
     }).catch(err => {
@@ -69,5 +79,484 @@ class Deleter {
   }
 }
 
+interface TokenInfo {
+  Id: string;
+  Name: string;
+  Scopes: string[];
+  Created: number;
+  LastUsed: number;
+}
+
+class Tokens {
+  private static scopes: string[] = ["read", "admin:delete", "admin:archive", "cron"];
+  private el: HTMLElement | null;
+  private list: HTMLElement | null = null;
+
+  constructor() {
+    this.el = document.getElementById("tokens");
+    if (this.el) {
+      this.render();
+      this.load();
+    }
+  }
+
+  private render(): void {
+    const form = document.createElement("form");
+    const name = document.createElement("input");
+    name.name = "name";
+    name.placeholder = "token name";
+    form.appendChild(name);
+    Tokens.scopes.forEach(scope => {
+      const label = document.createElement("label");
+      const box = document.createElement("input");
+      box.type = "checkbox";
+      box.name = "scope";
+      box.value = scope;
+      label.appendChild(box);
+      label.appendChild(document.createTextNode(scope));
+      form.appendChild(label);
+    });
+    const submit = document.createElement("button");
+    submit.type = "submit";
+    submit.textContent = "Create token";
+    form.appendChild(submit);
+    form.addEventListener("submit", (e: Event) => {
+      e.preventDefault();
+      this.create(form);
+    }, false);
+
+    this.list = document.createElement("ul");
+    this.el!.appendChild(form);
+    this.el!.appendChild(this.list);
+  }
+
+  private load(): void {
+    fetch("/admin/tokens", {
+      credentials: "include",
+      headers: new Headers({
+        'Accept': 'application/json'
+      }),
+    }).then(resp => resp.json()).then((tokens: TokenInfo[]) => {
+      this.list!.innerHTML = "";
+      tokens.forEach(token => this.list!.appendChild(this.item(token)));
+    }).catch(err => {
+      console.error("error loading tokens", err);
+    });
+  }
+
+  private item(token: TokenInfo): HTMLElement {
+    const li = document.createElement("li");
+    const used = token.LastUsed ? new Date(token.LastUsed * 1000).toLocaleString() : "never";
+    li.textContent = token.Name + " (" + token.Scopes.join(", ") + ") last used " + used + " ";
+    const revoke = document.createElement("button");
+    revoke.textContent = "Revoke";
+    revoke.addEventListener("click", () => {
+      this.revoke(token.Id);
+    }, false);
+    li.appendChild(revoke);
+    return li;
+  }
+
+  private create(form: HTMLFormElement): void {
+    const body = new URLSearchParams();
+    Array.from(form.elements).forEach((el: any) => {
+      if (el.name && (el.type !== "checkbox" || el.checked)) {
+        body.append(el.name, el.value);
+      }
+    });
+    fetch("/admin/tokens", {
+      method: "POST",
+      credentials: "include",
+      headers: new Headers({
+        'Accept': 'application/json',
+        'X-CSRF-Token': csrfToken()
+      }),
+      body
+    }).then(resp => resp.json()).then(created => {
+      if (created.Token) {
+        // the token is only ever shown once
+        window.prompt("Copy the new token, it will not be shown again", created.Token);
+        form.reset();
+        this.load();
+      }
+    }).catch(err => {
+      console.error("error creating token", err);
+    });
+  }
+
+  private revoke(id: string): void {
+    fetch("/admin/tokens/revoke?id=" + encodeURIComponent(id), {
+      method: "POST",
+      credentials: "include",
+      headers: new Headers({
+        'X-CSRF-Token': csrfToken()
+      }),
+    }).then(() => {
+      this.load();
+    }).catch(err => {
+      console.error("error revoking token", err);
+    });
+  }
+}
+
+interface Connection {
+  Account: string;
+  Connected: boolean;
+  ConnectedAt: number;
+  Revoked: boolean;
+}
+
+class Connections {
+  private el: HTMLElement | null;
+
+  constructor() {
+    this.el = document.getElementById("connections");
+    if (this.el) {
+      this.load();
+    }
+  }
+
+  private load(): void {
+    fetch("/admin/connect", {
+      credentials: "include",
+      headers: new Headers({
+        'Accept': 'application/json'
+      }),
+    }).then(resp => resp.json()).then((connections: Connection[]) => {
+      const list = document.createElement("ul");
+      connections.forEach(c => list.appendChild(this.item(c)));
+      this.el!.appendChild(list);
+    }).catch(err => {
+      console.error("error loading connections", err);
+    });
+  }
+
+  // connecting leaves the page for twitter, so it's a plain form post
+  private item(c: Connection): HTMLElement {
+    const li = document.createElement("li");
+    let state = "not connected";
+    if (c.Revoked) {
+      state = "revoked, re-authorize";
+    } else if (c.Connected) {
+      state = "connected " + new Date(c.ConnectedAt * 1000).toLocaleString();
+    }
+    li.textContent = "@" + c.Account + ": " + state + " ";
+
+    const form = document.createElement("form");
+    form.method = "POST";
+    form.action = "/admin/connect?account=" + encodeURIComponent(c.Account);
+    const csrf = document.createElement("input");
+    csrf.type = "hidden";
+    csrf.name = "csrf_token";
+    csrf.value = csrfToken();
+    form.appendChild(csrf);
+    const submit = document.createElement("button");
+    submit.type = "submit";
+    submit.textContent = c.Connected ? "Re-authorize" : "Connect";
+    form.appendChild(submit);
+    li.appendChild(form);
+    return li;
+  }
+}
+
+interface ConfigSetting {
+  Key: string;
+  Env: string;
+  Value: any;
+  Secret: boolean;
+  Set: boolean;
+}
+
+// read only, settings change in the config file or environment
+class ConfigView {
+  private el: HTMLElement | null;
+
+  constructor() {
+    this.el = document.getElementById("config");
+    if (this.el) {
+      this.load();
+    }
+  }
+
+  private load(): void {
+    fetch("/admin/config", {
+      credentials: "include",
+      headers: new Headers({
+        'Accept': 'application/json'
+      }),
+    }).then(resp => resp.json()).then((config: {Source: string, Settings: ConfigSetting[]}) => {
+      const source = document.createElement("p");
+      source.textContent = "Loaded from " + (config.Source || "the environment only");
+      const table = document.createElement("table");
+      config.Settings.forEach(s => {
+        const row = table.insertRow();
+        row.insertCell().textContent = s.Key;
+        row.insertCell().textContent = s.Secret ? (s.Set ? "(set)" : "(not set)") : JSON.stringify(s.Value);
+        row.insertCell().textContent = s.Env;
+      });
+      this.el!.appendChild(source);
+      this.el!.appendChild(table);
+    }).catch(err => {
+      console.error("error loading config", err);
+    });
+  }
+}
+
+interface MediaProblem {
+  TweetId: number;
+  ScreenName: string;
+  Path: string;
+  Problem: string;
+  Repaired: boolean;
+  Error: string;
+}
+
+interface MediaAuditReport {
+  Started: number;
+  Finished: number;
+  Repair: boolean;
+  Checked: number;
+  Queued: number;
+  ProblemCount: number;
+  RepairedCount: number;
+  Problems: MediaProblem[];
+}
+
+class MediaAudit {
+  private el: HTMLElement | null;
+  private report: HTMLElement | null = null;
+
+  constructor() {
+    this.el = document.getElementById("media-audit");
+    if (this.el) {
+      this.render();
+      this.load();
+    }
+  }
+
+  private render(): void {
+    [false, true].forEach(repair => {
+      const button = document.createElement("button");
+      button.type = "button";
+      button.textContent = repair ? "Audit and repair" : "Audit";
+      button.addEventListener("click", () => {
+        this.run(repair);
+      }, false);
+      this.el!.appendChild(button);
+    });
+    this.report = document.createElement("div");
+    this.el!.appendChild(this.report);
+  }
+
+  private load(): void {
+    fetch("/admin/media/audit", {
+      credentials: "include",
+      headers: new Headers({
+        'Accept': 'application/json'
+      }),
+    }).then(resp => resp.ok ? resp.json() : null).then((audit: MediaAuditReport | null) => {
+      if (audit) {
+        this.show(audit);
+      }
+    }).catch(err => {
+      console.error("error loading media audit", err);
+    });
+  }
+
+  private run(repair: boolean): void {
+    this.report!.textContent = "Auditing...";
+    fetch("/admin/media/audit?repair=" + repair, {
+      method: "POST",
+      credentials: "include",
+      headers: new Headers({
+        'Accept': 'application/json',
+        'X-CSRF-Token': csrfToken()
+      }),
+    }).then(resp => resp.json().then(body => {
+      if (resp.ok) {
+        this.show(body as MediaAuditReport);
+      } else {
+        this.report!.textContent = body.detail;
+      }
+    })).catch(err => {
+      this.report!.textContent = "";
+      console.error("error auditing media", err);
+    });
+  }
+
+  private show(audit: MediaAuditReport): void {
+    this.report!.innerHTML = "";
+    const summary = document.createElement("p");
+    // unfinished audits carry on in the /audit/media job
+    const when = audit.Finished ? new Date(audit.Finished * 1000).toLocaleString() :
+      "In progress since " + new Date(audit.Started * 1000).toLocaleString();
+    summary.textContent = when + ": " + audit.Checked + " checked, " +
+      audit.Queued + " waiting to download, " + audit.ProblemCount + " problems, " +
+      audit.RepairedCount + " repaired";
+    // only the first problems are kept
+    if (audit.ProblemCount > audit.Problems.length) {
+      summary.textContent += ", the first " + audit.Problems.length + " listed";
+    }
+    const list = document.createElement("ul");
+    audit.Problems.forEach(p => {
+      const li = document.createElement("li");
+      const owner = p.TweetId ? "tweet " + p.TweetId : "@" + p.ScreenName;
+      const outcome = p.Repaired ? " (repaired)" : (p.Error ? " (" + p.Error + ")" : "");
+      li.textContent = p.Path + " of " + owner + " is " + p.Problem + outcome;
+      list.appendChild(li);
+    });
+    this.report!.appendChild(summary);
+    this.report!.appendChild(list);
+  }
+}
+
+interface UserSnapshot {
+  Account: string;
+  Taken: number;
+  ScreenName: string;
+  Name: string;
+  Description: string;
+  Location: string;
+  Link: string;
+  Verified: boolean;
+  Followers: number;
+  Following: number;
+  TweetCount: number;
+  AvatarFileName: string;
+  BannerFileName: string;
+  Changed: string[];
+}
+
+class UserHistory {
+  private static svgNs = "http://www.w3.org/2000/svg";
+  private el: HTMLElement | null;
+  private history: HTMLElement | null = null;
+
+  constructor() {
+    this.el = document.getElementById("user-history");
+    if (this.el) {
+      this.render();
+    }
+  }
+
+  private render(): void {
+    const select = document.createElement("select");
+    select.addEventListener("change", () => {
+      this.load(select.value);
+    }, false);
+    this.history = document.createElement("div");
+    this.el!.appendChild(select);
+    this.el!.appendChild(this.history);
+
+    fetch("/users", {
+      credentials: "include",
+      headers: new Headers({
+        'Accept': 'application/json'
+      }),
+    }).then(resp => resp.json()).then((users: {ScreenName: string}[]) => {
+      users.forEach(user => {
+        const option = document.createElement("option");
+        option.value = option.textContent = user.ScreenName;
+        select.appendChild(option);
+      });
+      if (users.length > 0) {
+        this.load(users[0].ScreenName);
+      }
+    }).catch(err => {
+      console.error("error loading users", err);
+    });
+  }
+
+  private load(account: string): void {
+    fetch("/admin/users/history?account=" + encodeURIComponent(account), {
+      credentials: "include",
+      headers: new Headers({
+        'Accept': 'application/json'
+      }),
+    }).then(resp => resp.json()).then((snapshots: UserSnapshot[]) => {
+      this.history!.innerHTML = "";
+      this.history!.appendChild(this.chart(snapshots));
+      this.history!.appendChild(this.timeline(snapshots));
+    }).catch(err => {
+      console.error("error loading user history", err);
+    });
+  }
+
+  // followers and following over time, each line scaled to its own range
+  private chart(snapshots: UserSnapshot[]): Element {
+    const width = 600, height = 200;
+    const svg = document.createElementNS(UserHistory.svgNs, "svg");
+    svg.setAttribute("width", String(width));
+    svg.setAttribute("height", String(height));
+    if (snapshots.length < 2) {
+      return svg;
+    }
+    const first = snapshots[0].Taken, last = snapshots[snapshots.length - 1].Taken;
+    const series: [string, (s: UserSnapshot) => number][] = [
+      ["#1da1f2", s => s.Followers],
+      ["#999", s => s.Following]
+    ];
+    series.forEach(([color, value]) => {
+      const values = snapshots.map(value);
+      const low = Math.min(...values), high = Math.max(...values);
+      const points = snapshots.map(s => {
+        const x = (s.Taken - first) / (last - first || 1) * width;
+        const y = height - (value(s) - low) / (high - low || 1) * (height - 20) - 10;
+        return x.toFixed(1) + "," + y.toFixed(1);
+      });
+      const line = document.createElementNS(UserHistory.svgNs, "polyline");
+      line.setAttribute("points", points.join(" "));
+      line.setAttribute("fill", "none");
+      line.setAttribute("stroke", color);
+      const title = document.createElementNS(UserHistory.svgNs, "title");
+      title.textContent = (color === "#999" ? "following " : "followers ") + low + " to " + high;
+      line.appendChild(title);
+      svg.appendChild(line);
+    });
+    return svg;
+  }
+
+  // the profile changes, newest first
+  private timeline(snapshots: UserSnapshot[]): HTMLElement {
+    const list = document.createElement("ul");
+    snapshots.filter((s, i) => i === 0 || s.Changed.length > 0).reverse().forEach(s => {
+      const li = document.createElement("li");
+      if (s.AvatarFileName) {
+        const img = document.createElement("img");
+        img.src = "/media?file=" + encodeURIComponent(s.AvatarFileName);
+        img.width = 48;
+        li.appendChild(img);
+      }
+      const changes = s.Changed.length > 0 ? s.Changed.map(field => this.describe(s, field)).join("; ") : "first seen";
+      li.appendChild(document.createTextNode(new Date(s.Taken * 1000).toLocaleString() + ": " + changes));
+      if (s.BannerFileName && s.Changed.indexOf("banner") >= 0) {
+        const a = document.createElement("a");
+        a.href = "/media?file=" + encodeURIComponent(s.BannerFileName);
+        a.textContent = " banner";
+        li.appendChild(a);
+      }
+      list.appendChild(li);
+    });
+    return list;
+  }
+
+  private describe(s: UserSnapshot, field: string): string {
+    const values: {[field: string]: any} = {
+      screenName: s.ScreenName,
+      name: s.Name,
+      description: s.Description,
+      location: s.Location,
+      link: s.Link,
+      verified: s.Verified
+    };
+    return field in values ? field + " is now " + JSON.stringify(values[field]) : field + " changed";
+  }
+}
+
 let upload = new Upload();
 let deleter = new Deleter();
+let tokens = new Tokens();
+let connections = new Connections();
+let configView = new ConfigView();
+let mediaAudit = new MediaAudit();
+let userHistory = new UserHistory();
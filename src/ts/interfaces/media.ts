@@ -5,4 +5,15 @@ export interface Media {
     Type: string;
     MediaUrl: string;
     UploadFileName: string;
+    Hash: string;
+    Size: number;
+    ContentType: string;
+    Width: number;
+    Height: number;
+    Bitrate: number;
+    DurationMillis: number;
+    PosterFileName: string;
+    PosterUrl: string;
+    SmallFileName: string;
+    MediumFileName: string;
 }
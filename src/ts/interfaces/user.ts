@@ -15,4 +15,6 @@ export interface User {
   Link: string;
   Updated: number;
   Media: Media;
+  ProfileBannerUrl: string;
+  Banner: Media;
 }
@@ -1,6 +1,7 @@
 import { Pipe, PipeTransform } from '@angular/core';
 
 import { Tweet } from "../interfaces/tweet";
+import { Media } from "../interfaces/media";
 
 @Pipe({
   name: "ReplaceMedia"
@@ -9,12 +10,31 @@ export class ReplaceMediaPipe implements PipeTransform {
   public transform(tweet: Tweet): string {
     if (tweet.Media) {
       let text = tweet.Text;
+      // every photo of a tweet shares the one link
+      const html: {[url: string]: string} = {};
       tweet.Media.forEach(m => {
-        const url = "/media?file=" + m.UploadFileName;
-        text = text.replace(m.Url, `<img src="${url}" />`);
+        html[m.Url] = (html[m.Url] || "") + this.mediaHtml(m);
+      });
+      Object.keys(html).forEach(url => {
+        text = text.replace(url, html[url]);
       });
       return text;
     }
     return tweet.Text;
   }
+
+  private mediaHtml(m: Media): string {
+    const url = "/media?file=" + m.UploadFileName;
+    if (m.PosterFileName) {
+      const poster = "/media?file=" + m.PosterFileName + "&size=medium";
+      if (m.Type === "animated_gif") {
+        return `<video src="${url}" poster="${poster}" autoplay loop muted playsinline></video>`;
+      }
+      return `<video src="${url}" poster="${poster}" controls preload="none"></video>`;
+    }
+    if (m.MediumFileName) {
+      return `<a href="${url}" target="_blank"><img src="${url}&size=medium" /></a>`;
+    }
+    return `<img src="${url}" />`;
+  }
 }